@@ -36,7 +36,9 @@ BULLET_LIST :  '\\ul' ;
 
 ORDER_LIST :  '\\ol' ;
 
-TABLE :  '\\table' ; 
+TABLE :  '\\table' ;
+CHART :  '\\chart' ; 
+DIAGRAM :  '\\diagram' ; 
 
 INLINE_TEX :  '\\t' ; 
 
@@ -52,7 +54,9 @@ LIST_ITEM :  '\\-' ;
 
 PARAGRAPH_DELIM :  WS* LINE_END ;  //blank line 
 
-CELL_DELIM : '\\d' ; 
+CELL_DELIM : '\\d' ;
+ROW_END : '\\tr' ;
+SPAN : '\\span' ; 
 
 REFER_TO : '\\k' ; //refer to other keyword 
 
@@ -70,9 +74,11 @@ paragraph : line+ ;
 
 paragraphs : paragraph (PARAGRAPH_DELIM paragraph)* ; 
 
-block : image_block | list_block | raw_block  | block_python | block_code |block_tex |table_block  ;  
+block : image_block | list_block | raw_block  | block_python | block_code |block_tex |table_block | table_file_block | chart_block | diagram_block ;  
 
-embraced_id : LBRACE WS* ID WS* RBRACE ;
+separator : WS* LINE_END? WS* ; //allowed between a keyword and its blocks, and between two blocks of a keyword. It is omitted in the other rules for short. 
+
+embraced_id : LBRACE (WS | LINE_END)* ID (WS | LINE_END)* RBRACE ;
 
 embraced_block : LBRACE block RBRACE ; 
 
@@ -86,16 +92,24 @@ create_date :'\\create-date' string LINE_END ;
 
 modify_date :'\\modify-date' string LINE_END ;
 
-include :'\\include' string LINE_END ; //to import other document 
+include :'\\include' string LINE_END | '\\include' (LBRACE string RBRACE) embraced_id? ; //to import other document, or the section/anchor with the id in it 
 
 keywords :'\\keywords' string (',' string)* LINE_END ; 
 
+macro_def : '\\def' embraced_id LBRACE string RBRACE ; //#1 to #9 in string refer to the arguments 
+
+macro_use : '\\' ID (LBRACE string RBRACE)* ; //ID is defined by macro_def, it is replaced before other keywords are handled 
+
 section_index : '\\toc' ;
 
 image_index : '\\image-index' ;
 
 table_index : '\\table-index' ;
 
+chart_index : '\\chart-index' ;
+
+diagram_index : '\\diagram-index' ;
+
 order_list_index : '\\order-list-index' ; 
 
 bullet_list_index : '\\bullet-list-index' ; 
@@ -104,6 +118,8 @@ code_index : '\\code-index' ;
 
 math_index : '\\math-index' ;
 
+term_index : '\\index' ; //back-of-book index of the terms marked by index_block 
+
 section_header :  SECTION_MARK SECTION_LEVEL? (LBRACE ID RBRACE) string LINE_END ; 
 
 blocks : block* ; 
@@ -116,11 +132,17 @@ emphasis_block :  EMPHASIS embraced_block ;
 
 strong_block :  STRONG embraced_block ; 
 
-refer_to_block : REFER_TO (LBRACE ID RBRACE) ; 
+refer_to_block : REFER_TO (LBRACE ID RBRACE | LBRACE string '#' ID RBRACE) (LBRACE string RBRACE)? ; //the string before '#' is another file of the build, the last string is the text of the link 
 
 anchor_block : ANCHOR (LBRACE ID RBRACE) (LBRACE string RBRACE) ; 
 
-index_block : INDEX (LBRACE string RBRACE) ; 
+cite_block : '\\cite' (LBRACE string RBRACE) ; //keys of the bibliography separated by comma 
+
+bibliography : '\\bibliography' (LBRACE string RBRACE) ; //the BibTeX file, searched in the same way as include 
+
+footnote_block : '\\f' embraced_block ; //the content is listed at the end of the document or the top level section 
+
+index_block : INDEX (LBRACE string RBRACE) (LBRACE string RBRACE)? ; //term and optional subterm, for term_index 
 
 inline_comment_block : COMMENT (LBRACE string RBRACE) | raw_block; 
 
@@ -141,7 +163,9 @@ inline_block : emphasis_block
              | refer_to_block 
              | inline_comment_block
 			| anchor_block 
-			| index_block 
+			| index_block
+			| footnote_block
+			| cite_block 
 			
              ; 
 
@@ -155,9 +179,19 @@ bullet_list_block :  BULLET_LIST embraced_id LBRACE list_item+ RBRACE ;
 
 order_list_block :  ORDER_LIST embraced_id LBRACE list_item+ RBRACE ;
 
-table_row : string ( CELL_DELIM string)* ; 
+table_span : SPAN LBRACE string RBRACE (LBRACE string RBRACE)? ; //columns and rows
+
+table_cell : table_span? (inline_block | block | string)* ; //block and line ending only with rows=explicit
+
+table_row : table_cell ( CELL_DELIM table_cell)* ; 
+
+table_option : string '=' string ; //header=n, align=lcr, rows=explicit, file=path, delimiter=c, columns=1,3-4
 
-table_block :  TABLE embraced_id LBRACE table_row (LINE_END table_row)* RBRACE ; 
+table_block :  TABLE embraced_id (LBRACE table_option* RBRACE)? LBRACE table_row ((LINE_END | ROW_END) table_row)* RBRACE ; 
+
+table_file_block : TABLE embraced_id LBRACE table_option* RBRACE ; //one of the options is file=path, the rows are imported from the CSV or TSV file
+
+chart_block : CHART embraced_id ((LBRACE table_option* RBRACE)? LBRACE table_row ((LINE_END | ROW_END) table_row)* RBRACE | LBRACE table_option* RBRACE) ; //the options of table, and type=bar|line|pie, width=n, height=n
 
 inline_tex :  INLINE_TEX raw_block ; 
 
@@ -165,7 +199,9 @@ block_tex :  BLOCK_TEX embraced_id raw_block ;
 
 inline_code :  INLINE_CODE ((LBRACE string RBRACE) | raw_block) ; 
 
-block_code :  BLOCK_CODE embraced_id ((LBRACE string RBRACE) | raw_block) ; 
+block_code :  BLOCK_CODE embraced_id ((LBRACE string RBRACE) | raw_block) ;
+
+diagram_block :  DIAGRAM embraced_id ((LBRACE string RBRACE) | raw_block) ; //ASCII art of boxes, lines and arrows 
 
 block_python :  BLOCK_PYTHON embraced_id ((LBRACE string RBRACE) | raw_block) ; 
 
@@ -0,0 +1,629 @@
+package hairtail
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var errUnexpectedChunk = errors.New("unexpected chunk")
+
+// gKeywordContainers is the keywords that are only allowed inside other keywords, e.g. \d inside \table
+var gKeywordContainers = map[string]string{
+	TableCellDelimiterKeyword: EscapeChar + TableKeyword + " or " + EscapeChar + ChartKeyword,
+	TableRowDelimiterKeyword:  EscapeChar + TableKeyword + " or " + EscapeChar + ChartKeyword,
+	TableSpanKeyword:          EscapeChar + TableKeyword + " or " + EscapeChar + ChartKeyword,
+	ListItemMark:              EscapeChar + OrderList + " or " + EscapeChar + BulletList,
+}
+
+// Node is an element of the document tree.
+// The tree is built from the chunk list produced by the parsing passes. Every node knows its parent and children,
+// so that passes and renderers go through the document without type asserting KeywordChunk.Children.
+// The nodes refer to the chunks they are built from, changes to the chunks(e.g. setting numbering) are seen by both.
+type Node interface {
+	GetPosition() int
+	Parent() Node
+	Children() []Node
+	setParent(parent Node)
+	appendChild(child Node)
+}
+
+// InlineNode is implemented by the nodes that stay inside a paragraph
+type InlineNode interface {
+	Node
+	inlineNode()
+}
+
+// BlockNode is implemented by the nodes that are not inside a paragraph
+type BlockNode interface {
+	Node
+	blockNode()
+}
+
+// CaptionedNode is implemented by the block nodes that may have caption and numbering
+type CaptionedNode interface {
+	BlockNode
+	GetKeyword() string
+	Captioned() WithIdCaptionNumbering
+}
+
+// node implements the parent and children part of Node
+type node struct {
+	parent   Node
+	children []Node
+}
+
+// Parent implements the Node interface
+func (n *node) Parent() Node {
+	return n.parent
+}
+
+// Children implements the Node interface
+func (n *node) Children() []Node {
+	return n.children
+}
+
+func (n *node) setParent(parent Node) {
+	n.parent = parent
+}
+
+func (n *node) appendChild(child Node) {
+	n.children = append(n.children, child)
+}
+
+// keywordNode is the part shared by the nodes built from a KeywordChunk
+type keywordNode struct {
+	node
+	Keyword *KeywordChunk
+}
+
+// GetPosition implements the Node interface
+func (n *keywordNode) GetPosition() int {
+	return n.Keyword.GetPosition()
+}
+
+// GetKeyword returns the keyword the node is built from, e.g. "table"
+func (n *keywordNode) GetKeyword() string {
+	return n.Keyword.Keyword
+}
+
+// DocumentNode is the root of the tree
+type DocumentNode struct {
+	node
+}
+
+// GetPosition implements the Node interface
+func (n *DocumentNode) GetPosition() int {
+	return 0
+}
+
+// ParagraphNode denotes a paragraph, its children are inline nodes
+type ParagraphNode struct {
+	node
+	Position int
+}
+
+// GetPosition implements the Node interface
+func (n *ParagraphNode) GetPosition() int {
+	return n.Position
+}
+
+// SectionNode denotes a heading. Its children are the content of the section.
+type SectionNode struct {
+	keywordNode
+	Section *SectionChunk
+}
+
+// TextNode denotes plain text inside a paragraph
+type TextNode struct {
+	node
+	Text *PlainTextChunk
+}
+
+// GetPosition implements the Node interface
+func (n *TextNode) GetPosition() int {
+	return n.Text.GetPosition()
+}
+
+// RawTextNode denotes raw text
+type RawTextNode struct {
+	node
+	Text *RawTextChunk
+}
+
+// GetPosition implements the Node interface
+func (n *RawTextNode) GetPosition() int {
+	return n.Text.GetPosition()
+}
+
+// FormatNode denotes inline format, i.e. \e \s \w \c \t \--.
+// Its children are the content, for \w the first child is the url and the second the text.
+type FormatNode struct {
+	keywordNode
+}
+
+// AnchorNode denotes \a
+type AnchorNode struct {
+	keywordNode
+	Anchor *AnchorChunk
+}
+
+// ReferToNode denotes \k
+type ReferToNode struct {
+	keywordNode
+	ReferTo *ReferToChunk
+}
+
+// IndexTermNode denotes \i
+type IndexTermNode struct {
+	keywordNode
+	Term *IndexTermChunk
+}
+
+// FootnoteNode denotes \f, its children are the content of the footnote
+type FootnoteNode struct {
+	keywordNode
+	Footnote *FootnoteChunk
+}
+
+// InlineTexNode denotes \t
+type InlineTexNode struct {
+	keywordNode
+	Tex *InlineTexChunk
+}
+
+// CiteNode denotes \cite
+type CiteNode struct {
+	keywordNode
+	Cite *CiteChunk
+}
+
+// BibliographyNode denotes \bibliography
+type BibliographyNode struct {
+	keywordNode
+	Bibliography *BibliographyChunk
+}
+
+// ImageNode denotes \image
+type ImageNode struct {
+	keywordNode
+	Image *ImageChunk
+}
+
+// ChartNode denotes \chart
+type ChartNode struct {
+	keywordNode
+	Chart *ChartChunk
+}
+
+// DiagramNode denotes \diagram
+type DiagramNode struct {
+	keywordNode
+	Diagram *DiagramChunk
+}
+
+// ListNode denotes \ol and \ul, its children are ListItemNode
+type ListNode struct {
+	keywordNode
+	List *ListChunk
+}
+
+// ListItemNode denotes \- inside a list
+type ListItemNode struct {
+	node
+	Item     *ListItem
+	Position int
+}
+
+// GetPosition implements the Node interface
+func (n *ListItemNode) GetPosition() int {
+	return n.Position
+}
+
+// TableNode denotes \table, its children are TableRowNode
+type TableNode struct {
+	keywordNode
+	Table *TableChunk
+}
+
+// TableRowNode denotes a row of table, its children are TableCellNode
+type TableRowNode struct {
+	node
+	Position int
+}
+
+// GetPosition implements the Node interface
+func (n *TableRowNode) GetPosition() int {
+	return n.Position
+}
+
+// TableCellNode denotes a cell of table, its children are inline nodes
+type TableCellNode struct {
+	node
+	Cell *TableCell
+}
+
+// GetPosition implements the Node interface
+func (n *TableCellNode) GetPosition() int {
+	return n.Cell.Position
+}
+
+// BlockCodeNode denotes \code
+type BlockCodeNode struct {
+	keywordNode
+	Code *BlockCodeChunk
+}
+
+// BlockTexNode denotes \tex
+type BlockTexNode struct {
+	keywordNode
+	Tex *BlockTexChunk
+}
+
+// MetaNode denotes meta data of the document, e.g. \title, and \include
+type MetaNode struct {
+	keywordNode
+}
+
+// IndexNode denotes the place to put an index, e.g. \toc
+type IndexNode struct {
+	keywordNode
+}
+
+// CaptionNode denotes \caption that has not been set to the block it refers to
+type CaptionNode struct {
+	keywordNode
+}
+
+// CustomNode denotes a block keyword registered with RegisterKeyword. Its children are the nodes of KeywordChunk.Args.
+type CustomNode struct {
+	keywordNode
+}
+
+// CustomInlineNode denotes an inline keyword registered with RegisterKeyword. Its children are the nodes of KeywordChunk.Args.
+type CustomInlineNode struct {
+	keywordNode
+}
+
+func (n *TextNode) inlineNode()         {}
+func (n *RawTextNode) inlineNode()      {}
+func (n *FormatNode) inlineNode()       {}
+func (n *AnchorNode) inlineNode()       {}
+func (n *ReferToNode) inlineNode()      {}
+func (n *IndexTermNode) inlineNode()    {}
+func (n *FootnoteNode) inlineNode()     {}
+func (n *CiteNode) inlineNode()         {}
+func (n *InlineTexNode) inlineNode()    {}
+func (n *CustomInlineNode) inlineNode() {}
+
+func (n *ParagraphNode) blockNode()    {}
+func (n *SectionNode) blockNode()      {}
+func (n *ImageNode) blockNode()        {}
+func (n *ChartNode) blockNode()        {}
+func (n *DiagramNode) blockNode()      {}
+func (n *ListNode) blockNode()         {}
+func (n *ListItemNode) blockNode()     {}
+func (n *TableNode) blockNode()        {}
+func (n *TableRowNode) blockNode()     {}
+func (n *TableCellNode) blockNode()    {}
+func (n *BlockCodeNode) blockNode()    {}
+func (n *BlockTexNode) blockNode()     {}
+func (n *MetaNode) blockNode()         {}
+func (n *IndexNode) blockNode()        {}
+func (n *CaptionNode) blockNode()      {}
+func (n *CustomNode) blockNode()       {}
+func (n *BibliographyNode) blockNode() {}
+
+// Captioned implements the CaptionedNode interface
+func (n *ImageNode) Captioned() WithIdCaptionNumbering {
+	return n.Image
+}
+
+// Captioned implements the CaptionedNode interface
+func (n *ChartNode) Captioned() WithIdCaptionNumbering {
+	return n.Chart
+}
+
+// Captioned implements the CaptionedNode interface
+func (n *DiagramNode) Captioned() WithIdCaptionNumbering {
+	return n.Diagram
+}
+
+// Captioned implements the CaptionedNode interface
+func (n *ListNode) Captioned() WithIdCaptionNumbering {
+	return n.List
+}
+
+// Captioned implements the CaptionedNode interface
+func (n *TableNode) Captioned() WithIdCaptionNumbering {
+	return n.Table
+}
+
+// Captioned implements the CaptionedNode interface
+func (n *BlockCodeNode) Captioned() WithIdCaptionNumbering {
+	return n.Code
+}
+
+// Captioned implements the CaptionedNode interface
+func (n *BlockTexNode) Captioned() WithIdCaptionNumbering {
+	return n.Tex
+}
+
+// Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children of node with the visitor w,
+// followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses the tree in depth-first order
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	for _, child := range node.Children() {
+		Walk(v, child)
+	}
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses the tree in depth-first order, it calls f(node) for each node.
+// If f returns true, Inspect invokes f for each of the children of node, followed by a call of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// BuildTree builds the document tree from the chunk list produced by the parsing passes
+func BuildTree(chunks []Chunk) (*DocumentNode, error) {
+	doc := &DocumentNode{}
+	err := appendNodes(doc, chunks)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func appendChild(parent, child Node) {
+	child.setParent(parent)
+	parent.appendChild(child)
+}
+
+// appendNodes builds nodes of chunks and append them to parent.
+// Inline nodes next to each other are put in paragraphs, a blank line in the plain text begins a new paragraph.
+func appendNodes(parent Node, chunks []Chunk) error {
+	var paragraph *ParagraphNode
+
+	endParagraph := func() {
+		if paragraph == nil {
+			return
+		}
+		//paragraph with only blanks is ignored
+		for _, child := range paragraph.Children() {
+			textNode, ok := child.(*TextNode)
+			if !ok || len(strings.Trim(textNode.Text.GetValue(), BlankChars)) > 0 {
+				appendChild(parent, paragraph)
+				break
+			}
+		}
+		paragraph = nil
+	}
+	appendInline := func(child Node) {
+		if paragraph == nil {
+			paragraph = &ParagraphNode{Position: child.GetPosition()}
+		}
+		appendChild(paragraph, child)
+	}
+
+	for _, chunk := range chunks {
+		if plainTextChunk, ok := chunk.(*PlainTextChunk); ok {
+			start := 0
+			for i, loc := range gParagraphDivider.FindAllStringIndex(plainTextChunk.Value, math.MaxInt64) {
+				if i > 0 || loc[0] > 0 {
+					appendInline(&TextNode{Text: &PlainTextChunk{Position: plainTextChunk.Position + start, Value: plainTextChunk.Value[start:loc[0]]}})
+				}
+				endParagraph()
+				start = loc[1]
+			}
+			if start == 0 {
+				appendInline(&TextNode{Text: plainTextChunk})
+			} else if start < len(plainTextChunk.Value) {
+				appendInline(&TextNode{Text: &PlainTextChunk{Position: plainTextChunk.Position + start, Value: plainTextChunk.Value[start:]}})
+			}
+			continue
+		}
+
+		child, err := newNode(chunk)
+		if err != nil {
+			return err
+		}
+		if _, ok := child.(InlineNode); ok {
+			appendInline(child)
+			continue
+		}
+		endParagraph()
+		appendChild(parent, child)
+	}
+	endParagraph()
+	return nil
+}
+
+// newNode builds the node of chunk, and the nodes of its children recursively
+func newNode(chunk Chunk) (Node, error) {
+	switch c := chunk.(type) {
+	case *PlainTextChunk:
+		return &TextNode{Text: c}, nil
+	case *RawTextChunk:
+		return &RawTextNode{Text: c}, nil
+	case *KeywordChunk:
+		return newKeywordNode(c)
+	}
+	return nil, newDiagnostic(chunk, fmt.Errorf("%w %q", errUnexpectedChunk, chunk.GetValue()))
+}
+
+func newKeywordNode(keywordChunk *KeywordChunk) (Node, error) {
+	base := keywordNode{Keyword: keywordChunk}
+	unexpected := func() (Node, error) {
+		keyword := EscapeChar + keywordChunk.Keyword
+		if container, ok := gKeywordContainers[keywordChunk.Keyword]; ok {
+			return nil, newDiagnostic(keywordChunk, fmt.Errorf("%w: %s is only allowed inside %s", errUnexpectedChunk, keyword, container))
+		}
+		return nil, newDiagnostic(keywordChunk, fmt.Errorf("%w: ill-formed %s", errUnexpectedChunk, keyword))
+	}
+	var first Chunk
+	if len(keywordChunk.Children) > 0 {
+		first = keywordChunk.Children[0]
+	}
+
+	switch keywordChunk.Keyword {
+	case EmphasisFormat, StrongFormat, HyperLink, InlineCode, CommentKeyword:
+		//\w has the url and the text, the others have the content only
+		if len(keywordChunk.Children) < 1 || keywordChunk.Keyword == HyperLink && len(keywordChunk.Children) < 2 {
+			return unexpected()
+		}
+		n := &FormatNode{keywordNode: base}
+		for _, child := range keywordChunk.Children {
+			childNode, err := newNode(child)
+			if err != nil {
+				return nil, err
+			}
+			appendChild(n, childNode)
+		}
+		return n, nil
+	case AnchorBlock:
+		if c, ok := first.(*AnchorChunk); ok {
+			return &AnchorNode{keywordNode: base, Anchor: c}, nil
+		}
+	case ReferToBlock:
+		if c, ok := first.(*ReferToChunk); ok {
+			return &ReferToNode{keywordNode: base, ReferTo: c}, nil
+		}
+	case IndexTerm:
+		if c, ok := first.(*IndexTermChunk); ok {
+			return &IndexTermNode{keywordNode: base, Term: c}, nil
+		}
+	case Footnote:
+		if c, ok := first.(*FootnoteChunk); ok {
+			n := &FootnoteNode{keywordNode: base, Footnote: c}
+			for _, child := range c.Content {
+				childNode, err := newNode(child)
+				if err != nil {
+					return nil, err
+				}
+				appendChild(n, childNode)
+			}
+			return n, nil
+		}
+	case InlineTex:
+		if c, ok := first.(*InlineTexChunk); ok {
+			return &InlineTexNode{keywordNode: base, Tex: c}, nil
+		}
+	case CiteKeyword:
+		if c, ok := first.(*CiteChunk); ok {
+			return &CiteNode{keywordNode: base, Cite: c}, nil
+		}
+	case BibliographyKeyword:
+		if c, ok := first.(*BibliographyChunk); ok {
+			return &BibliographyNode{keywordNode: base, Bibliography: c}, nil
+		}
+	case ImageKeyword:
+		if c, ok := first.(*ImageChunk); ok {
+			return &ImageNode{keywordNode: base, Image: c}, nil
+		}
+	case ChartKeyword:
+		if c, ok := first.(*ChartChunk); ok {
+			return &ChartNode{keywordNode: base, Chart: c}, nil
+		}
+	case DiagramKeyword:
+		if c, ok := first.(*DiagramChunk); ok {
+			return &DiagramNode{keywordNode: base, Diagram: c}, nil
+		}
+	case BlockCode:
+		if c, ok := first.(*BlockCodeChunk); ok {
+			return &BlockCodeNode{keywordNode: base, Code: c}, nil
+		}
+	case BlockTex:
+		if c, ok := first.(*BlockTexChunk); ok {
+			return &BlockTexNode{keywordNode: base, Tex: c}, nil
+		}
+	case SectionHeader, SectionHeader1, SectionHeader2, SectionHeader3,
+		SectionHeader4, SectionHeader5, SectionHeader6:
+		if c, ok := first.(*SectionChunk); ok {
+			n := &SectionNode{keywordNode: base, Section: c}
+			return n, appendNodes(n, c.Children)
+		}
+	case OrderList, BulletList:
+		if c, ok := first.(*ListChunk); ok {
+			n := &ListNode{keywordNode: base, List: c}
+			for _, item := range c.Items {
+				itemNode := &ListItemNode{Item: item, Position: c.GetPosition()}
+				if len(item.Value) > 0 {
+					itemNode.Position = item.Value[0].GetPosition()
+				}
+				if err := appendNodes(itemNode, item.Value); err != nil {
+					return nil, err
+				}
+				appendChild(n, itemNode)
+			}
+			return n, nil
+		}
+	case TableKeyword:
+		if c, ok := first.(*TableChunk); ok {
+			n := &TableNode{keywordNode: base, Table: c}
+			for _, row := range c.Cells {
+				rowNode := &TableRowNode{Position: c.GetPosition()}
+				for _, cell := range row {
+					cellNode := &TableCellNode{Cell: cell}
+					for _, chunk := range cell.Value {
+						childNode, err := newNode(chunk)
+						if err != nil {
+							return nil, err
+						}
+						appendChild(cellNode, childNode)
+					}
+					appendChild(rowNode, cellNode)
+				}
+				if len(row) > 0 {
+					rowNode.Position = row[0].Position
+				}
+				appendChild(n, rowNode)
+			}
+			return n, nil
+		}
+	case TitleKeyword, SubTitleKeyword, AuthorKeyword, CreateDateKeyword, ModifyDateKeyword, KeywordsKeyword, IncludeKeyword:
+		return &MetaNode{keywordNode: base}, nil
+	case SectionIndexKeyword, ImageIndexKeyword, TableIndexKeyword, ChartIndexKeyword, DiagramIndexKeyword, OrderListIndexKeyword, BulletListIndexKeyword, CodeIndexKeyword, MathIndexKeyword, TermIndexKeyword:
+		return &IndexNode{keywordNode: base}, nil
+	case CaptionKeyword:
+		return &CaptionNode{keywordNode: base}, nil
+	default:
+		handler := lookupKeyword(keywordChunk.Keyword)
+		if handler == nil || handler.Parse != nil {
+			break
+		}
+		var n Node = &CustomNode{keywordNode: base}
+		if handler.Inline {
+			n = &CustomInlineNode{keywordNode: base}
+		}
+		for _, arg := range keywordChunk.Args {
+			for _, child := range arg {
+				childNode, err := newNode(child)
+				if err != nil {
+					return nil, err
+				}
+				appendChild(n, childNode)
+			}
+		}
+		return n, nil
+	}
+	return unexpected()
+}
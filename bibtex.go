@@ -0,0 +1,258 @@
+package hairtail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var errBibTeXSyntax = errors.New("bibtex syntax error")
+
+// BibEntry is an entry of a BibTeX file, e.g. @article{key, author = {...}, title = {...}}
+type BibEntry struct {
+	Type   string            //lower case, e.g. "article"
+	Key    string            //cited by \cite{key}
+	Fields map[string]string //by lower case field name, braces and redundant blanks are removed from the values
+	Number int               //in the order of first citation, 0 if it is not cited
+}
+
+// Id is the id of the entry in the reference list, \cite links to it
+func (e *BibEntry) Id() string {
+	return "bib-" + e.Key
+}
+
+// Authors returns the authors in the form of "A, B and C"
+func (e *BibEntry) Authors() string {
+	authors := strings.Split(e.Fields["author"], " and ")
+	for i := range authors {
+		authors[i] = strings.TrimSpace(authors[i])
+	}
+	if len(authors) <= 1 {
+		return authors[0]
+	}
+	return strings.Join(authors[:len(authors)-1], ", ") + " and " + authors[len(authors)-1]
+}
+
+// Source returns where the entry is published, i.e. the journal, the book or the publisher
+func (e *BibEntry) Source() string {
+	for _, field := range []string{"journal", "booktitle", "publisher", "school", "institution", "howpublished"} {
+		if source := e.Fields[field]; source != "" {
+			return source
+		}
+	}
+	return ""
+}
+
+// Reference returns the entry in the reference list, e.g. "A and B. <em>Title</em>. Journal, 2020."
+func (e *BibEntry) Reference() string {
+	var parts []string
+	if authors := e.Authors(); authors != "" {
+		parts = append(parts, authors)
+	}
+	if title := e.Fields["title"]; title != "" {
+		parts = append(parts, "<em>"+title+"</em>")
+	}
+	var published []string
+	for _, s := range []string{e.Source(), e.Fields["year"]} {
+		if s != "" {
+			published = append(published, s)
+		}
+	}
+	if len(published) > 0 {
+		parts = append(parts, strings.Join(published, ", "))
+	}
+	reference := strings.Join(parts, ". ")
+	if reference != "" {
+		reference += "."
+	}
+	if url := e.Fields["url"]; url != "" {
+		reference += ` <a href="` + url + `">` + url + `</a>`
+	}
+	return reference
+}
+
+// bibTeXParser parses the entries of a BibTeX file. @string, @preamble and @comment are skipped.
+type bibTeXParser struct {
+	input []rune
+	pos   int
+}
+
+// parseBibTeX returns the entries in input in order
+func parseBibTeX(input string) ([]*BibEntry, error) {
+	p := &bibTeXParser{input: []rune(input)}
+	var entries []*BibEntry
+	for {
+		//the text between entries is comment
+		for p.pos < len(p.input) && p.input[p.pos] != '@' {
+			p.pos++
+		}
+		if p.pos >= len(p.input) {
+			return entries, nil
+		}
+		p.pos++
+		entryType := strings.ToLower(p.name())
+		p.skipBlanks()
+		if p.pos >= len(p.input) || (p.input[p.pos] != '{' && p.input[p.pos] != '(') {
+			return entries, p.errorf("expect { after @%s", entryType)
+		}
+		switch entryType {
+		case "string", "preamble", "comment":
+			if _, err := p.braced(); err != nil {
+				return entries, err
+			}
+			continue
+		}
+		closing := '}'
+		if p.input[p.pos] == '(' {
+			closing = ')'
+		}
+		p.pos++
+		p.skipBlanks()
+		entry := &BibEntry{Type: entryType, Key: p.key(), Fields: make(map[string]string)}
+		if entry.Key == "" {
+			return entries, p.errorf("expect key of @%s", entryType)
+		}
+		for {
+			p.skipBlanks()
+			if p.pos < len(p.input) && p.input[p.pos] == ',' {
+				p.pos++
+				p.skipBlanks()
+			}
+			if p.pos >= len(p.input) {
+				return entries, p.errorf("expect %c at the end of %s", closing, entry.Key)
+			}
+			if p.input[p.pos] == closing {
+				p.pos++
+				break
+			}
+			field := strings.ToLower(p.name())
+			p.skipBlanks()
+			if field == "" || p.pos >= len(p.input) || p.input[p.pos] != '=' {
+				return entries, p.errorf("expect field = value in %s", entry.Key)
+			}
+			p.pos++
+			value, err := p.value()
+			if err != nil {
+				return entries, err
+			}
+			entry.Fields[field] = value
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// errorf reports an error at the line of the current position
+func (p *bibTeXParser) errorf(format string, args ...interface{}) error {
+	line := 1
+	for _, r := range p.input[:p.pos] {
+		if r == '\n' {
+			line++
+		}
+	}
+	return fmt.Errorf("%w: line %d: %s", errBibTeXSyntax, line, fmt.Sprintf(format, args...))
+}
+
+func (p *bibTeXParser) skipBlanks() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// name consumes the name of an entry type or a field
+func (p *bibTeXParser) name() string {
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsLetter(p.input[p.pos]) || unicode.IsDigit(p.input[p.pos]) || strings.ContainsRune("-_:.", p.input[p.pos])) {
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+// key consumes the key of an entry, which is up to the comma
+func (p *bibTeXParser) key() string {
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(",})", p.input[p.pos]) && !unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+// value consumes the value of a field, which is braced, quoted, a number, or pieces of them joined by #
+func (p *bibTeXParser) value() (string, error) {
+	var buf strings.Builder
+	for {
+		p.skipBlanks()
+		if p.pos >= len(p.input) {
+			return "", p.errorf("expect value")
+		}
+		switch r := p.input[p.pos]; {
+		case r == '{':
+			s, err := p.braced()
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(s)
+		case r == '"':
+			start := p.pos
+			p.pos++
+			depth := 0
+			for p.pos < len(p.input) && (p.input[p.pos] != '"' || depth > 0) {
+				if p.input[p.pos] == '{' {
+					depth++
+				} else if p.input[p.pos] == '}' {
+					depth--
+				}
+				p.pos++
+			}
+			if p.pos >= len(p.input) {
+				p.pos = start
+				return "", p.errorf("expect \" at the end of value")
+			}
+			buf.WriteString(string(p.input[start+1 : p.pos]))
+			p.pos++
+		default:
+			//a number, or the name of a @string, which is taken as it is
+			name := p.name()
+			if name == "" {
+				return "", p.errorf("expect value")
+			}
+			buf.WriteString(name)
+		}
+		p.skipBlanks()
+		if p.pos < len(p.input) && p.input[p.pos] == '#' {
+			p.pos++
+			continue
+		}
+		return cleanBibTeXValue(buf.String()), nil
+	}
+}
+
+// braced consumes the text in braces or parentheses, and returns it without them
+func (p *bibTeXParser) braced() (string, error) {
+	start := p.pos
+	opening, closing := p.input[p.pos], '}'
+	if opening == '(' {
+		closing = ')'
+	}
+	depth := 0
+	for ; p.pos < len(p.input); p.pos++ {
+		switch p.input[p.pos] {
+		case opening:
+			depth++
+		case closing:
+			depth--
+			if depth == 0 {
+				p.pos++
+				return string(p.input[start+1 : p.pos-1]), nil
+			}
+		}
+	}
+	p.pos = start
+	return "", p.errorf("expect %c", closing)
+}
+
+// cleanBibTeXValue removes the braces, which keep the case of letters in BibTeX, and the redundant blanks
+func cleanBibTeXValue(value string) string {
+	value = strings.NewReplacer("{", "", "}", "", "~", " ", "\\&", "&").Replace(value)
+	return strings.Join(strings.Fields(value), " ")
+}
@@ -1,4 +1,4 @@
-package main
+package hairtail
 
 import (
 	"fmt"
@@ -11,6 +11,34 @@ type BlockTexChunk struct {
 	Caption   string //optional
 	Numbering string //optional Numbering before Caption
 	Value     string
+	MathML    string //set in TexChunkHandle, empty if the tex is left to MathJax
+}
+
+// InlineTexChunk denotes a tex formula in a line of text, i.e. the content of \t
+type InlineTexChunk struct {
+	Position int
+	Value    string
+	MathML   string //set in TexChunkHandle, empty if the tex is left to MathJax
+}
+
+// String implements the Stringer interface
+func (p InlineTexChunk) String() string {
+	return fmt.Sprintf("InlineTexChunk{Position: %d, Value: %v}", p.GetPosition(), p.Value)
+}
+
+// GetPosition implements the Chunk interface
+func (p *InlineTexChunk) GetPosition() int {
+	return p.Position
+}
+
+// SetPosition implements the Chunk interface
+func (p *InlineTexChunk) SetPosition(pos int) {
+	p.Position = pos
+}
+
+// GetValue implements the Chunk interface
+func (p *InlineTexChunk) GetValue() string {
+	return p.Value
 }
 
 // String implements the Stringer interface
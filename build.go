@@ -0,0 +1,344 @@
+package hairtail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errUnknownReference   = errors.New("unknown reference")
+	errAmbiguousReference = errors.New("ambiguous reference, the id is in more than one file")
+	errDuplicateId        = errors.New("duplicate id")
+	errFirstDefinition    = errors.New("first defined here")
+	errDuplicateOutput    = errors.New("output file of more than one input file")
+)
+
+// BuildFile is one document of a multi-file build
+type BuildFile struct {
+	InputFile  string
+	OutputFile string
+}
+
+// Symbol is something in a build that \k refers to, i.e. a section, an anchor or a captioned block
+type Symbol struct {
+	Position  int //where the symbol is defined in the document
+	Id        string
+	Keyword   string //the keyword defining the symbol, e.g. "table"
+	Caption   string
+	Numbering string
+	File      BuildFile //the document defining the symbol, the symbols of included files belong to the including document
+}
+
+// SymbolTable collects the symbols of every document of a build, so that \k refers to ids in other documents
+type SymbolTable struct {
+	Files   []BuildFile
+	symbols map[string][]*Symbol //by id
+}
+
+// newSymbolTable returns an empty table of the documents in files
+func newSymbolTable(files []BuildFile) *SymbolTable {
+	return &SymbolTable{Files: files, symbols: make(map[string][]*Symbol)}
+}
+
+// Lookup returns the symbols with id, in the order of the files
+func (t *SymbolTable) Lookup(id string) []*Symbol {
+	return t.symbols[id]
+}
+
+// add collects the symbols of file, ids is the symbols of the document by id
+func (t *SymbolTable) add(file BuildFile, ids map[string]*Symbol) {
+	for id, symbol := range ids {
+		symbol.File = file
+		t.symbols[id] = append(t.symbols[id], symbol)
+	}
+}
+
+// IdChunkHandle collects the sections, anchors and blocks with id in the numbered chunks, so that \k is checked against them.
+// An id defined more than once is reported with both definitions, the first one is kept.
+func (doc *Doc) IdChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+	tree, err := BuildTree(inputChunks)
+	if err != nil {
+		return inputChunks, err
+	}
+
+	doc.ids = make(map[string]*Symbol)
+	var diagnostics DiagnosticList
+	Inspect(tree, func(n Node) bool {
+		var symbol *Symbol
+		switch n := n.(type) {
+		case *SectionNode:
+			symbol = &Symbol{Id: n.Section.Id, Keyword: n.GetKeyword(), Caption: n.Section.Caption, Numbering: n.Section.Numbering}
+		case *AnchorNode:
+			symbol = &Symbol{Id: n.Anchor.Id, Keyword: n.GetKeyword(), Caption: n.Anchor.Value}
+		case CaptionedNode:
+			c := n.Captioned()
+			symbol = &Symbol{Id: c.GetId(), Keyword: n.GetKeyword(), Caption: c.GetCaption(), Numbering: c.GetNumbering()}
+		default:
+			return true
+		}
+		if symbol.Id == "" {
+			return true
+		}
+		symbol.Position = n.GetPosition()
+		first, ok := doc.ids[symbol.Id]
+		if !ok {
+			doc.ids[symbol.Id] = symbol
+			return true
+		}
+		diagnostic := &Diagnostic{Position: symbol.Position, Keyword: symbol.Keyword, Err: fmt.Errorf("%w %q", errDuplicateId, symbol.Id),
+			Related: &Diagnostic{Position: first.Position, Keyword: first.Keyword, Err: errFirstDefinition}}
+		diagnostics.add(doc.warn(diagnostic))
+		return true
+	})
+	return inputChunks, diagnostics.err()
+}
+
+// findFile returns the document of the build that name refers to, name is relative to the directory of the referring document
+func (t *SymbolTable) findFile(dir, name string) (BuildFile, bool) {
+	path := includePath(dir, name)
+	for _, file := range t.Files {
+		if sameFile(file.InputFile, path) {
+			return file, true
+		}
+	}
+	return BuildFile{}, false
+}
+
+// ReferToChunkHandle resolves where \k links to.
+// \k{id} links to the same document if id is defined there, otherwise to the only document of the build defining it.
+// \k{file#id} links to the document of the build compiled from file.
+func (doc *Doc) ReferToChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+	tree, err := BuildTree(inputChunks)
+	if err != nil {
+		return inputChunks, err
+	}
+
+	var diagnostics DiagnosticList
+	Inspect(tree, func(n Node) bool {
+		referToNode, ok := n.(*ReferToNode)
+		if !ok {
+			return true
+		}
+		referTo := referToNode.ReferTo
+		href, symbol, err := doc.resolveReferTo(referTo)
+		referTo.Href = href
+		if referTo.Value == "" {
+			referTo.Value = doc.referText(referTo.Id, symbol)
+		}
+		if err != nil {
+			err = newDiagnostic(referToNode.Keyword, err)
+			if errors.Is(err, errUnknownReference) {
+				err = doc.warn(err)
+			}
+			diagnostics.add(err)
+		}
+		return false
+	})
+	return inputChunks, diagnostics.err()
+}
+
+// resolveReferTo returns the href of referTo and what it refers to.
+// If it is not resolved, the href is "#id" as if the id were in the same document, and the symbol is nil.
+func (doc *Doc) resolveReferTo(referTo *ReferToChunk) (string, *Symbol, error) {
+	local := "#" + referTo.Id
+	if doc.symbols == nil {
+		//a single document refers to itself only
+		if referTo.File != "" && !sameFile(includePath(filepath.Dir(doc.FilePath), referTo.File), doc.FilePath) {
+			return local, nil, fmt.Errorf("%w %s#%s: %s is not compiled together", errUnknownReference, referTo.File, referTo.Id, referTo.File)
+		}
+		symbol := doc.ids[referTo.Id]
+		if symbol == nil {
+			return local, nil, fmt.Errorf("%w %q", errUnknownReference, referTo.Id)
+		}
+		return local, symbol, nil
+	}
+
+	var symbols []*Symbol
+	if referTo.File != "" {
+		file, ok := doc.symbols.findFile(filepath.Dir(doc.FilePath), referTo.File)
+		if !ok {
+			return local, nil, fmt.Errorf("%w %s#%s: %s is not in the build", errUnknownReference, referTo.File, referTo.Id, referTo.File)
+		}
+		for _, symbol := range doc.symbols.Lookup(referTo.Id) {
+			if symbol.File == file {
+				symbols = append(symbols, symbol)
+			}
+		}
+		if len(symbols) == 0 {
+			return local, nil, fmt.Errorf("%w %s#%s", errUnknownReference, referTo.File, referTo.Id)
+		}
+	} else {
+		symbols = doc.symbols.Lookup(referTo.Id)
+	}
+
+	var files []string
+	for _, symbol := range symbols {
+		if sameFile(symbol.File.InputFile, doc.FilePath) {
+			return local, symbol, nil
+		}
+		files = append(files, symbol.File.InputFile)
+	}
+	switch len(files) {
+	case 0:
+		return local, nil, fmt.Errorf("%w %q", errUnknownReference, referTo.Id)
+	case 1:
+		return doc.relativeHref(symbols[0].File.OutputFile) + local, symbols[0], nil
+	}
+	return local, nil, fmt.Errorf("%w %q: %s, use \\k{file#%s}", errAmbiguousReference, referTo.Id, strings.Join(files, ", "), referTo.Id)
+}
+
+// referText returns the text of a link to symbol, e.g. "Table 3" or "2.1 install".
+// id is the text if symbol is nil, i.e. the reference is not resolved.
+func (doc *Doc) referText(id string, symbol *Symbol) string {
+	if symbol == nil {
+		return id
+	}
+	switch {
+	case symbol.Keyword == AnchorBlock:
+		if symbol.Caption != "" {
+			return symbol.Caption
+		}
+	case gChunkWithCaptionMap[symbol.Keyword]:
+		//a block is numbered only if it has a caption, e.g. "Table 3: "
+		if symbol.Numbering != "" {
+			return strings.TrimSuffix(strings.TrimSpace(symbol.Numbering), ":")
+		}
+		return doc.getKeywordName(symbol.Keyword)
+	default:
+		//section
+		if text := strings.TrimSpace(symbol.Numbering + " " + symbol.Caption); text != "" {
+			return text
+		}
+	}
+	return id
+}
+
+// relativeHref returns the link from the output file of doc to outputFile
+func (doc *Doc) relativeHref(outputFile string) string {
+	rel, err := filepath.Rel(filepath.Dir(doc.outputFile), outputFile)
+	if err != nil {
+		return filepath.ToSlash(outputFile)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// CompileBuild compiles the documents of a multi-file build.
+// The symbols of every document are collected before any document is rendered, so that \k refers to ids in other documents.
+// The results are in the order of files.
+func CompileBuild(ctx context.Context, files []BuildFile, opts Options) ([]*Result, error) {
+	opts, err := checkOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	//one document would overwrite the other, and the links to it would go to the wrong one
+	for i, file := range files {
+		for _, other := range files[:i] {
+			if sameFile(file.OutputFile, other.OutputFile) {
+				return nil, fmt.Errorf("%w %s: %s and %s", errDuplicateOutput, file.OutputFile, other.InputFile, file.InputFile)
+			}
+		}
+	}
+
+	var (
+		symbols     = newSymbolTable(files)
+		docs        = make([]*Doc, len(files))
+		chunkLists  = make([][]Chunk, len(files))
+		diagnostics DiagnosticList
+	)
+	//fail adds the diagnostics of one document, it returns the error if the build is not able to go on
+	fail := func(doc *Doc, err error) error {
+		err = doc.fileError(err)
+		if !diagnostics.add(err) {
+			return err
+		}
+		if doc.tooManyErrors(diagnostics) {
+			return diagnostics[:opts.MaxErrors]
+		}
+		return nil
+	}
+
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		inputContent, err := ioutil.ReadFile(file.InputFile)
+		if err != nil {
+			return nil, err
+		}
+		fileOpts := opts
+		fileOpts.FilePath = file.InputFile
+		doc := newDoc(fileOpts)
+		doc.symbols = symbols
+		doc.outputFile = file.OutputFile
+		docs[i] = doc
+
+		chunks, err := doc.parseChunks(string(inputContent))
+		if err == nil {
+			chunks, err = doc.numberChunks(chunks)
+			err = doc.locateDiagnostic(err)
+		}
+		if err != nil {
+			if err := fail(doc, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		symbols.add(file, doc.ids)
+		chunkLists[i] = chunks
+	}
+	if len(diagnostics) > 0 {
+		return nil, diagnostics
+	}
+
+	results := make([]*Result, len(files))
+	for i, doc := range docs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		chunks, err := doc.linkChunks(chunkLists[i])
+		if err != nil {
+			if err := fail(doc, doc.locateDiagnostic(err)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		doc.locateDiagnostic(doc.warnings)
+		results[i], err = doc.render(chunks)
+		if err != nil {
+			if err := fail(doc, doc.locateDiagnostic(err)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(diagnostics) > 0 {
+		return nil, diagnostics
+	}
+	return results, nil
+}
+
+// Build compiles the documents of a multi-file build, and writes every output file, the directories of which are created if needed.
+// It returns the warnings of every document.
+func Build(files []BuildFile, opts Options) (DiagnosticList, error) {
+	results, err := CompileBuild(context.Background(), files, opts)
+	if err != nil {
+		return nil, err
+	}
+	var warnings DiagnosticList
+	for i, result := range results {
+		warnings = append(warnings, result.Warnings...)
+		err = os.MkdirAll(filepath.Dir(files[i].OutputFile), 0777)
+		if err != nil {
+			return warnings, err
+		}
+		err = ioutil.WriteFile(files[i].OutputFile, []byte(result.Content), 0666)
+		if err != nil {
+			return warnings, err
+		}
+	}
+	return warnings, nil
+}
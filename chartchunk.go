@@ -0,0 +1,403 @@
+package hairtail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// the types of \chart, set by type=
+const (
+	ChartBar  = "bar"
+	ChartLine = "line"
+	ChartPie  = "pie"
+)
+
+var (
+	errUnknownChartType = errors.New("unknown chart type, expect bar, line or pie")
+	errInvalidChartData = errors.New("invalid chart data")
+)
+
+// gChartColors is the colors of the series of bar and line charts, or the slices of pie charts, in order
+var gChartColors = []string{"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f", "#edc948", "#b07aa1", "#ff9da7", "#9c755f", "#bab0ac"}
+
+// ChartSeries is a column of the data of a chart
+type ChartSeries struct {
+	Name   string    //the header of the column, empty if the data has no header row
+	Values []float64 //by row, NaN if the cell is empty
+}
+
+// ChartChunk denotes chart, the data is a table whose first column is the labels, and the other columns are the series
+type ChartChunk struct {
+	Position  int
+	Id        string
+	Caption   string //optional
+	Numbering string //optional Numbering before Caption
+	Type      string //ChartBar, ChartLine or ChartPie
+	Width     int    //of the svg, in pixels
+	Height    int
+	Labels    []string       //by row
+	Series    []*ChartSeries //a pie chart shows the first one only
+}
+
+// String implements the Stringer interface
+func (p ChartChunk) String() string {
+	return fmt.Sprintf("ChartChunk{Position: %d, Id: %v, Caption: %v, Type: %v, Labels: %v, Series: %v}",
+		p.GetPosition(), p.Id, p.Caption, p.Type, p.Labels, p.Series)
+}
+
+// GetPosition implements the Chunk interface
+func (p *ChartChunk) GetPosition() int {
+	return p.Position
+}
+
+// SetPosition implements the Chunk interface
+func (p *ChartChunk) SetPosition(pos int) {
+	p.Position = pos
+}
+
+// GetValue implements the Chunk interface
+func (p *ChartChunk) GetValue() string {
+	return p.Id
+}
+
+func (p *ChartChunk) GetId() string {
+	return p.Id
+}
+
+func (p *ChartChunk) GetCaption() string {
+	return p.Caption
+}
+
+func (p *ChartChunk) SetCaption(c string) {
+	p.Caption = c
+}
+
+func (p *ChartChunk) SetNumbering(c string) {
+	p.Numbering = c
+}
+
+func (p ChartChunk) GetNumbering() string {
+	return p.Numbering
+}
+
+func (doc *Doc) chartBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	chartChunk := &ChartChunk{Position: token.GetPosition(), Type: ChartBar, Width: 480, Height: 300}
+	tableChunk, newIndex, err := doc.consumeTable(token, inputChunks, index, chartChunk.setOption)
+	if err != nil {
+		return outputChunks, index, err
+	}
+	chartChunk.Id = tableChunk.Id
+	err = chartChunk.setData(tableChunk)
+	if err != nil {
+		return outputChunks, index, err
+	}
+
+	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
+		Keyword:  token.GetValue(),
+		Children: []Chunk{chartChunk},
+	}
+	outputChunks = append(outputChunks, keywordChunk)
+	return outputChunks, newIndex, nil
+}
+
+// setOption handles the options of \chart besides the ones of \table
+func (p *ChartChunk) setOption(key, value string) error {
+	switch key {
+	case "type":
+		switch value {
+		case ChartBar, ChartLine, ChartPie:
+			p.Type = value
+		default:
+			return fmt.Errorf("%w, got %q", errUnknownChartType, value)
+		}
+	case "width", "height":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 100 {
+			return fmt.Errorf("%w \"%s=%s\", expect 100 pixels at least", errInvalidTableOption, key, value)
+		}
+		if key == "width" {
+			p.Width = n
+		} else {
+			p.Height = n
+		}
+	default:
+		return fmt.Errorf("%w %q", errUnknownTableOption, key)
+	}
+	return nil
+}
+
+// setData takes the labels and series from the cells of table.
+// The last header row names the series, the other rows are labels followed by numbers.
+func (p *ChartChunk) setData(table *TableChunk) error {
+	if table.Columns < 2 {
+		return fmt.Errorf("%w, expect a column of labels and a column of numbers at least", errInvalidChartData)
+	}
+	p.Labels = nil
+	p.Series = make([]*ChartSeries, table.Columns-1)
+	for i := range p.Series {
+		p.Series[i] = &ChartSeries{}
+	}
+	for row, cells := range table.Cells {
+		texts := make([]string, table.Columns)
+		for _, cell := range cells {
+			if cell.ColSpan > 1 || cell.RowSpan > 1 {
+				return &Diagnostic{Position: cell.Position, Keyword: ChartKeyword, Err: fmt.Errorf("%w, a cell of chart spans one column and one row", errInvalidChartData)}
+			}
+			text, err := tableCellText(cell)
+			if err != nil {
+				return err
+			}
+			texts[cell.Column] = text
+		}
+		if table.IsHeaderRow(row) {
+			for i, series := range p.Series {
+				series.Name = texts[i+1]
+			}
+			continue
+		}
+		p.Labels = append(p.Labels, texts[0])
+		for i, series := range p.Series {
+			value := math.NaN()
+			if texts[i+1] != "" {
+				var err error
+				value, err = strconv.ParseFloat(texts[i+1], 64)
+				if err != nil || math.IsInf(value, 0) || math.IsNaN(value) {
+					return &Diagnostic{Position: cells[i+1].Position, Keyword: ChartKeyword, Err: fmt.Errorf("%w, expect a number, got %q", errInvalidChartData, texts[i+1])}
+				}
+				if p.Type == ChartPie && value < 0 {
+					return &Diagnostic{Position: cells[i+1].Position, Keyword: ChartKeyword, Err: fmt.Errorf("%w, expect a number not negative for pie, got %q", errInvalidChartData, texts[i+1])}
+				}
+			}
+			series.Values = append(series.Values, value)
+		}
+	}
+	if len(p.Labels) == 0 {
+		return fmt.Errorf("%w, no row of numbers", errInvalidChartData)
+	}
+	if p.Type == ChartPie && p.pieTotal() == 0 {
+		return fmt.Errorf("%w, the slices of pie add up to 0", errInvalidChartData)
+	}
+	//the numbers are finite, but the span of the axis or the total of pie may overflow
+	span := p.pieTotal()
+	if p.Type != ChartPie {
+		low, high, _ := p.axisRange()
+		span = high - low
+	}
+	if math.IsInf(span, 0) || math.IsNaN(span) {
+		return fmt.Errorf("%w, the numbers are too large to draw", errInvalidChartData)
+	}
+	return nil
+}
+
+// tableCellText returns the plain text of cell, which is not expected to have keywords
+func tableCellText(cell *TableCell) (string, error) {
+	var text string
+	for _, chunk := range cell.Value {
+		if _, ok := chunk.(*PlainTextChunk); !ok {
+			return "", newDiagnostic(chunk, errExpectPlainText)
+		}
+		text += chunk.GetValue()
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// SVG draws the chart as a self-contained svg element
+func (p *ChartChunk) SVG() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`+"\n",
+		p.Width, p.Height, p.Width, p.Height)
+	if p.Type == ChartPie {
+		p.pieSVG(&buf)
+	} else {
+		p.axisSVG(&buf)
+	}
+	buf.WriteString("</svg>")
+	return buf.String()
+}
+
+// axisSVG draws the bar and line charts, the labels are along the x axis, and the numbers along the y axis
+func (p *ChartChunk) axisSVG(buf *bytes.Buffer) {
+	left, right, top, bottom := 50.0, float64(p.Width)-10, 10.0, float64(p.Height)-30
+	//the legend is above the chart if the series are named
+	if x := left; p.Series[0].Name != "" || len(p.Series) > 1 {
+		for i, series := range p.Series {
+			name := series.Name
+			if name == "" {
+				name = strconv.Itoa(i + 1)
+			}
+			fmt.Fprintf(buf, `<rect x="%.1f" y="4" width="10" height="10" fill="%s"/><text x="%.1f" y="13">%s</text>`+"\n",
+				x, chartColor(i), x+14, html.EscapeString(name))
+			x += 24 + textWidth(name)
+		}
+		top = 24
+	}
+
+	low, high, step := p.axisRange()
+	y := func(value float64) float64 {
+		return bottom - (value-low)/(high-low)*(bottom-top)
+	}
+	decimals := 0
+	if step < 1 {
+		decimals = int(math.Ceil(-math.Log10(step)))
+	}
+	for i := 0; low+float64(i)*step <= high+step/2; i++ {
+		value := low + float64(i)*step
+		fmt.Fprintf(buf, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/><text x="%.1f" y="%.1f" text-anchor="end">%s</text>`+"\n",
+			left, y(value), right, y(value), left-4, y(value)+4, strconv.FormatFloat(value, 'f', decimals, 64))
+	}
+
+	band := (right - left) / float64(len(p.Labels))
+	for i, label := range p.Labels {
+		fmt.Fprintf(buf, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`+"\n", left+(float64(i)+0.5)*band, bottom+16, html.EscapeString(label))
+	}
+
+	switch p.Type {
+	case ChartLine:
+		for s, series := range p.Series {
+			var path, points bytes.Buffer
+			command := "M"
+			for i, value := range series.Values {
+				if math.IsNaN(value) {
+					command = "M" //the line breaks at the empty cells
+					continue
+				}
+				x := left + (float64(i)+0.5)*band
+				fmt.Fprintf(&path, "%s%.1f %.1f ", command, x, y(value))
+				fmt.Fprintf(&points, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"><title>%s: %s</title></circle>`+"\n",
+					x, y(value), chartColor(s), html.EscapeString(p.Labels[i]), strconv.FormatFloat(value, 'f', -1, 64))
+				command = "L"
+			}
+			fmt.Fprintf(buf, `<path d="%s" fill="none" stroke="%s" stroke-width="2"/>`+"\n", strings.TrimSpace(path.String()), chartColor(s))
+			buf.Write(points.Bytes())
+		}
+	default:
+		width := band * 0.8 / float64(len(p.Series))
+		for i := range p.Labels {
+			for s, series := range p.Series {
+				value := series.Values[i]
+				if math.IsNaN(value) {
+					continue
+				}
+				fmt.Fprintf(buf, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s: %s</title></rect>`+"\n",
+					left+float64(i)*band+band*0.1+float64(s)*width, math.Min(y(value), y(0)), width, math.Abs(y(value)-y(0)), chartColor(s),
+					html.EscapeString(p.Labels[i]), strconv.FormatFloat(value, 'f', -1, 64))
+			}
+		}
+	}
+	fmt.Fprintf(buf, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#333"/>`+"\n", left, y(0), right, y(0))
+}
+
+// pieSVG draws the pie chart of the first series, the legend is on the right
+func (p *ChartChunk) pieSVG(buf *bytes.Buffer) {
+	values := p.Series[0].Values
+	total := p.pieTotal()
+	legendWidth := 0.0
+	for i, label := range p.Labels {
+		legendWidth = math.Max(legendWidth, textWidth(pieLegend(label, values[i], total)))
+	}
+	radius := math.Min(float64(p.Height)-20, float64(p.Width)-legendWidth-44) / 2
+	radius = math.Max(radius, 10)
+	cx, cy := 10+radius, float64(p.Height)/2
+
+	angle := -math.Pi / 2 //from 12 o'clock, clockwise
+	for i, value := range values {
+		if math.IsNaN(value) || value == 0 {
+			continue
+		}
+		title := html.EscapeString(pieLegend(p.Labels[i], value, total))
+		if value == total {
+			fmt.Fprintf(buf, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s"><title>%s</title></circle>`+"\n", cx, cy, radius, chartColor(i), title)
+			break
+		}
+		end := angle + value/total*2*math.Pi
+		large := 0
+		if end-angle > math.Pi {
+			large = 1
+		}
+		fmt.Fprintf(buf, `<path d="M%.1f %.1f L%.1f %.1f A%.1f %.1f 0 %d 1 %.1f %.1f Z" fill="%s" stroke="#fff"><title>%s</title></path>`+"\n",
+			cx, cy, cx+radius*math.Cos(angle), cy+radius*math.Sin(angle), radius, radius, large, cx+radius*math.Cos(end), cy+radius*math.Sin(end),
+			chartColor(i), title)
+		angle = end
+	}
+
+	x := cx + radius + 20
+	for i, label := range p.Labels {
+		y := 10 + float64(i)*18
+		fmt.Fprintf(buf, `<rect x="%.1f" y="%.1f" width="10" height="10" fill="%s"/><text x="%.1f" y="%.1f">%s</text>`+"\n",
+			x, y, chartColor(i), x+14, y+9, html.EscapeString(pieLegend(label, values[i], total)))
+	}
+}
+
+// pieTotal returns the sum of the slices of pie
+func (p *ChartChunk) pieTotal() float64 {
+	total := 0.0
+	for _, value := range p.Series[0].Values {
+		if !math.IsNaN(value) {
+			total += value
+		}
+	}
+	return total
+}
+
+// pieLegend returns the text of a slice in the legend, e.g. "done 25%"
+func pieLegend(label string, value, total float64) string {
+	if math.IsNaN(value) {
+		value = 0
+	}
+	return fmt.Sprintf("%s %s%%", label, strconv.FormatFloat(value/total*100, 'f', 1, 64))
+}
+
+// chartColor returns the color of the i-th series or slice
+func chartColor(i int) string {
+	return gChartColors[i%len(gChartColors)]
+}
+
+// axisRange returns the lowest and highest ticks of the value axis, which includes 0, and the step between the ticks
+func (p *ChartChunk) axisRange() (low, high, step float64) {
+	for _, series := range p.Series {
+		for _, value := range series.Values {
+			if !math.IsNaN(value) {
+				low, high = math.Min(low, value), math.Max(high, value)
+			}
+		}
+	}
+	step = niceStep(high - low)
+	low, high = math.Floor(low/step)*step, math.Ceil(high/step)*step
+	if high == low {
+		high = low + step
+	}
+	return low, high, step
+}
+
+// niceStep returns the step between the ticks of an axis spanning span, it is 1, 2 or 5 times a power of 10
+func niceStep(span float64) float64 {
+	if span <= 0 {
+		return 1
+	}
+	raw := span / 5
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, nice := range []float64{1, 2, 5} {
+		if raw <= nice*magnitude {
+			return nice * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+// textWidth estimates the width of text in pixels at font size 12, the wide chars e.g. Chinese ones take twice the width
+func textWidth(text string) float64 {
+	width := 0.0
+	for _, r := range text {
+		if r < 0x1100 {
+			width += 7
+		} else {
+			width += 12
+		}
+	}
+	return width
+}
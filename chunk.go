@@ -1,10 +1,11 @@
-package main
+package hairtail
 
 import (
 	"bytes"
 	"errors"
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -68,63 +69,166 @@ func (p MetaCharChunk) String() string {
 
 //ParseChunks is the top level function to Parse input string to Chunks
 //there maybe be several passes to finish parsing
-func ParseChunks(input string) ([]Chunk, error) {
-	var (
-		chunks []Chunk
-		err    error
-	)
-	chunks, err = RawTextChunkHandle(input)
+func (doc *Doc) ParseChunks(input string) ([]Chunk, error) {
+	chunks, err := doc.parseChunks(input)
 	if err != nil {
-		log.Fatalln(err)
 		return chunks, err
 	}
-	chunks, err = MetaChunkHandle(chunks)
+	chunks, err = doc.numberChunks(chunks)
 	if err != nil {
-		log.Fatalln(err)
-		return chunks, err
+		return chunks, doc.locateDiagnostic(err)
 	}
+	chunks, err = doc.linkChunks(chunks)
+	if err != nil {
+		return chunks, doc.locateDiagnostic(err)
+	}
+	doc.locateDiagnostic(doc.warnings)
+	return chunks, nil
+}
 
-	chunks, err = KeywordChunkHandle(chunks)
+//numberChunks sets the numbering of sections and blocks, generates the indices of the document, and collects the ids
+func (doc *Doc) numberChunks(chunks []Chunk) ([]Chunk, error) {
+	chunks, err := doc.SectionChunkHandle(chunks)
 	if err != nil {
-		log.Fatalln(err)
 		return chunks, err
 	}
-
-	chunks, err = IncludeChunkHandle(chunks)
+	chunks, err = doc.ChunkWithNumberingHandle(chunks)
 	if err != nil {
-		log.Fatalln(err)
 		return chunks, err
 	}
-
-	chunks, err = CaptionChunkHandle(chunks)
+	chunks, err = doc.IndexTermChunkHandle(chunks)
 	if err != nil {
-		log.Fatalln(err)
 		return chunks, err
 	}
-	chunks, err = SectionChunkHandle(chunks)
+	chunks, err = doc.FootnoteChunkHandle(chunks)
 	if err != nil {
-		log.Fatalln(err)
 		return chunks, err
 	}
-	chunks, err = ChunkWithNumberingHandle(chunks)
+	chunks, err = doc.CiteChunkHandle(chunks)
+	if err != nil {
+		return chunks, err
+	}
+	chunks, err = doc.TexChunkHandle(chunks)
+	if err != nil {
+		return chunks, err
+	}
+	return doc.IdChunkHandle(chunks)
+}
+
+//linkChunks resolves the references, renders inline chunks, nests the sections and lists the footnotes.
+//In a build, it runs after the numbering of every document is done, so that references to other documents are resolved.
+func (doc *Doc) linkChunks(chunks []Chunk) ([]Chunk, error) {
+	chunks, err := doc.ReferToChunkHandle(chunks)
 	if err != nil {
-		log.Fatalln(err)
 		return chunks, err
 	}
 
-	gInlineRenderMode = true
+	doc.inlineRenderMode = true
 	//first render inlineChunk, so that there is not extra <p> around inlineChunk
-	chunks, err = InlineChunkListRender(chunks)
+	chunks, err = doc.InlineChunkListRender(chunks)
+	if err != nil {
+		return chunks, err
+	}
+
+	chunks, err = SectionNestHandle(chunks)
 	if err != nil {
-		log.Fatalln(err)
 		return chunks, err
 	}
+	return doc.FootnoteListHandle(chunks)
+}
+
+//parseChunks runs the passes that turn input to chunks.
+//Included files go through these passes only, the passes following them in ParseChunks(e.g. numbering) run once for the whole document.
+func (doc *Doc) parseChunks(input string) ([]Chunk, error) {
+	var (
+		chunks []Chunk
+		err    error
+	)
+	//the positions of an included file follow the ones of the texts parsed before it, see Doc.addSource
+	base := doc.addSource(doc.currentFile(), input)
+	chunks, err = RawTextChunkHandle(input)
+	if err == nil {
+		chunks, err = MetaChunkHandle(chunks)
+	}
+	if err != nil {
+		forEachDiagnostic(err, func(diag *Diagnostic) {
+			diag.Position += base
+		})
+		return chunks, doc.locateDiagnostic(err)
+	}
+	for _, chunk := range chunks {
+		chunk.SetPosition(chunk.GetPosition() + base)
+	}
 
+	//the errors of these passes are collected, so that as many errors as possible are reported in one run
+	var diagnostics DiagnosticList
+	for _, pass := range []func([]Chunk) ([]Chunk, error){doc.MacroChunkHandle, doc.KeywordChunkHandle, doc.IncludeChunkHandle, CaptionChunkHandle} {
+		chunks, err = pass(chunks)
+		if !diagnostics.add(err) {
+			return chunks, doc.locateDiagnostic(err)
+		}
+		if doc.tooManyErrors(diagnostics) {
+			break
+		}
+	}
+	if len(diagnostics) > 0 {
+		return chunks, doc.locateDiagnostic(diagnostics)
+	}
 	return chunks, nil
 }
 
+//SectionNestHandle puts the chunks following a section into SectionChunk.Children,
+//up to the next section of the same or higher level.
+//Sections that are nested already(e.g. sections of included document) are flattened first, and nested again here.
+func SectionNestHandle(inputChunks []Chunk) ([]Chunk, error) {
+	var outputChunks []Chunk
+	var openSections []*SectionChunk //the innermost section is at the end
+
+	for _, chunk := range flattenSections(inputChunks) {
+		sectionChunk := getSectionChunk(chunk)
+		if sectionChunk != nil {
+			for len(openSections) > 0 && openSections[len(openSections)-1].Level >= sectionChunk.Level {
+				openSections = openSections[:len(openSections)-1]
+			}
+		}
+		if len(openSections) == 0 {
+			outputChunks = append(outputChunks, chunk)
+		} else {
+			parent := openSections[len(openSections)-1]
+			parent.Children = append(parent.Children, chunk)
+		}
+		if sectionChunk != nil {
+			openSections = append(openSections, sectionChunk)
+		}
+	}
+	return outputChunks, nil
+}
+
+//flattenSections moves SectionChunk.Children back to the chunk list, right after the section
+func flattenSections(inputChunks []Chunk) []Chunk {
+	var outputChunks []Chunk
+	for _, chunk := range inputChunks {
+		outputChunks = append(outputChunks, chunk)
+		if sectionChunk := getSectionChunk(chunk); sectionChunk != nil {
+			outputChunks = append(outputChunks, flattenSections(sectionChunk.Children)...)
+			sectionChunk.Children = nil
+		}
+	}
+	return outputChunks
+}
+
+//getSectionChunk returns the SectionChunk of a section keyword, or nil if chunk is not a section
+func getSectionChunk(chunk Chunk) *SectionChunk {
+	keywordChunk, ok := chunk.(*KeywordChunk)
+	if !ok || len(keywordChunk.Children) == 0 {
+		return nil
+	}
+	sectionChunk, _ := keywordChunk.Children[0].(*SectionChunk)
+	return sectionChunk
+}
+
 //SectionChunkHandle set numbering of SectionChunk
-func SectionChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+func (doc *Doc) SectionChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
 	sectionChunkList := []*SectionChunk{}
 	var levels []int
 	var levelMap = make(map[int]bool)
@@ -167,16 +271,18 @@ func SectionChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
 		return buf.String()
 	}
 
-	for _, c := range inputChunks {
-		if keywordChunk, ok := c.(*KeywordChunk); ok {
-			level, isSection := gSectionLevel[keywordChunk.Keyword]
-			if isSection {
-				sectionChunkList = append(sectionChunkList, keywordChunk.Children[0].(*SectionChunk))
-				storeLevel(level)
-			}
-		}
-		sort.Ints(levels)
+	tree, err := BuildTree(inputChunks)
+	if err != nil {
+		return nil, err
 	}
+	Inspect(tree, func(node Node) bool {
+		if sectionNode, ok := node.(*SectionNode); ok {
+			sectionChunkList = append(sectionChunkList, sectionNode.Section)
+			storeLevel(sectionNode.Section.Level)
+		}
+		return true
+	})
+	sort.Ints(levels)
 
 	var bufSectionIndex bytes.Buffer
 
@@ -192,42 +298,46 @@ func SectionChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
 			return nil, err
 		}
 	}
-	gDoc.SectionIndex = bufSectionIndex.String()
+	doc.SectionIndex = bufSectionIndex.String()
 
 	return inputChunks, nil
 }
 
 //Chunk with numbering handle
-func ChunkWithNumberingHandle(inputChunks []Chunk) ([]Chunk, error) {
+func (doc *Doc) ChunkWithNumberingHandle(inputChunks []Chunk) ([]Chunk, error) {
 	numberingMap := make(map[string]int)       //to generate numbering
 	indexMap := make(map[string]*bytes.Buffer) //to generate index
 
-	for _, chunk := range inputChunks {
-		keywordChunk, ok := chunk.(*KeywordChunk)
-		if !ok {
-			continue
+	tree, err := BuildTree(inputChunks)
+	if err != nil {
+		return nil, err
+	}
+	Inspect(tree, func(node Node) bool {
+		captionedNode, ok := node.(CaptionedNode)
+		if !ok || err != nil {
+			return err == nil
 		}
-		if gChunkWithCaptionMap[keywordChunk.Keyword] {
-			chunkWithIdCaptionNumbering := keywordChunk.Children[0].(WithIdCaptionNumbering)
-			//only chunks that the caption has been set, we set numbering for them
-			if len(chunkWithIdCaptionNumbering.GetCaption()) > 0 {
-				numberingMap[keywordChunk.Keyword]++
-				prefix := getKeywordName(keywordChunk.Keyword)
-				//set numbering
-				chunkWithIdCaptionNumbering.SetNumbering(prefix + " " + strconv.Itoa(numberingMap[keywordChunk.Keyword]) + ": ")
-
-				//generate index for this type
-				buf := indexMap[keywordChunk.Keyword]
-				if nil == buf {
-					buf = new(bytes.Buffer)
-					indexMap[keywordChunk.Keyword] = buf
-				}
-				err := gGlobalIndexTemplate.Execute(buf, chunkWithIdCaptionNumbering)
-				if err != nil {
-					return nil, err
-				}
+		keyword := captionedNode.GetKeyword()
+		chunkWithIdCaptionNumbering := captionedNode.Captioned()
+		//only chunks that the caption has been set, we set numbering for them
+		if len(chunkWithIdCaptionNumbering.GetCaption()) > 0 {
+			numberingMap[keyword]++
+			prefix := doc.getKeywordName(keyword)
+			//set numbering
+			chunkWithIdCaptionNumbering.SetNumbering(prefix + " " + strconv.Itoa(numberingMap[keyword]) + ": ")
+
+			//generate index for this type
+			buf := indexMap[keyword]
+			if nil == buf {
+				buf = new(bytes.Buffer)
+				indexMap[keyword] = buf
 			}
+			err = gGlobalIndexTemplate.Execute(buf, chunkWithIdCaptionNumbering)
 		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	//set indices to global doc obj
@@ -236,17 +346,21 @@ func ChunkWithNumberingHandle(inputChunks []Chunk) ([]Chunk, error) {
 		if buf != nil {
 			switch keyword {
 			case OrderList:
-				gDoc.OrderListIndex = buf.String()
+				doc.OrderListIndex = buf.String()
 			case BulletList:
-				gDoc.BulletListIndex = buf.String()
+				doc.BulletListIndex = buf.String()
 			case TableKeyword:
-				gDoc.TableIndex = buf.String()
+				doc.TableIndex = buf.String()
 			case BlockCode:
-				gDoc.CodeIndex = buf.String()
+				doc.CodeIndex = buf.String()
 			case BlockTex:
-				gDoc.MathIndex = buf.String()
+				doc.MathIndex = buf.String()
 			case ImageKeyword:
-				gDoc.ImageIndex = buf.String()
+				doc.ImageIndex = buf.String()
+			case ChartKeyword:
+				doc.ChartIndex = buf.String()
+			case DiagramKeyword:
+				doc.DiagramIndex = buf.String()
 			}
 		}
 	}
@@ -254,46 +368,296 @@ func ChunkWithNumberingHandle(inputChunks []Chunk) ([]Chunk, error) {
 	return inputChunks, nil
 }
 
-//CaptionChunkHandle filter the Caption chunk, and set caption to the chunk it refers to
-func CaptionChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
-	outputChunks := []Chunk{}
-	idToChunk := make(map[string]Chunk)
-	captionChunks := []Chunk{}
+//IndexTermChunkHandle sets the ids of the terms marked by \i, and generates the back-of-book index of them.
+//A term in the index links to every place it is marked, the text of the link is the numbering of the section the place is in.
+func (doc *Doc) IndexTermChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+	tree, err := BuildTree(inputChunks)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		terms   []*IndexTermChunk
+		section *SectionChunk
+	)
+	Inspect(tree, func(node Node) bool {
+		switch n := node.(type) {
+		case *SectionNode:
+			section = n.Section
+		case *IndexTermNode:
+			n.Term.Id = "index-term-" + strconv.Itoa(len(terms)+1)
+			if section != nil {
+				n.Term.Numbering = section.Numbering
+			}
+			terms = append(terms, n.Term)
+		}
+		return true
+	})
+	if len(terms) == 0 {
+		return inputChunks, nil
+	}
+
+	type ref struct{ Id, Text string }
+	type entry struct {
+		Term string
+		Sub  bool
+		Refs []ref
+	}
+	type group struct {
+		Initial string
+		Entries []*entry
+	}
+	//the entries of terms, and the entries of subterms following the term they belong to
+	entries := make(map[string]*entry)
+	subEntries := make(map[string]map[string]*entry)
+	var termList []string
+	for _, term := range terms {
+		e := entries[term.Term]
+		if e == nil {
+			e = &entry{Term: term.Term}
+			entries[term.Term] = e
+			subEntries[term.Term] = make(map[string]*entry)
+			termList = append(termList, term.Term)
+		}
+		if term.SubTerm != "" {
+			if e = subEntries[term.Term][term.SubTerm]; e == nil {
+				e = &entry{Term: term.SubTerm, Sub: true}
+				subEntries[term.Term][term.SubTerm] = e
+			}
+		}
+		text := term.Numbering
+		if text == "" {
+			text = strconv.Itoa(len(e.Refs) + 1)
+		}
+		e.Refs = append(e.Refs, ref{term.Id, text})
+	}
+	sort.SliceStable(termList, func(i, j int) bool {
+		return termLess(termList[i], termList[j])
+	})
+
+	var groups []*group
+	for _, term := range termList {
+		initial := string(termInitial(term))
+		if len(groups) == 0 || groups[len(groups)-1].Initial != initial {
+			groups = append(groups, &group{Initial: initial})
+		}
+		g := groups[len(groups)-1]
+		g.Entries = append(g.Entries, entries[term])
+		var subTermList []string
+		for subTerm := range subEntries[term] {
+			subTermList = append(subTermList, subTerm)
+		}
+		sort.Slice(subTermList, func(i, j int) bool {
+			return termLess(subTermList[i], subTermList[j])
+		})
+		for _, subTerm := range subTermList {
+			g.Entries = append(g.Entries, subEntries[term][subTerm])
+		}
+	}
+
+	var buf bytes.Buffer
+	err = gTermIndexTemplate.Execute(&buf, groups)
+	if err != nil {
+		return nil, err
+	}
+	doc.TermIndex = buf.String()
+	return inputChunks, nil
+}
+
+//FootnoteChunkHandle numbers the footnotes per document, or per top level section if Options.FootnotesPerSection is set.
+//It runs before the sections are nested, a section is top level if no section before it is of a higher level, the same as SectionNestHandle.
+func (doc *Doc) FootnoteChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+	doc.footnotes = []footnoteGroup{{}}
+	count := 0    //of the whole document, to make the ids
+	topLevel := 0 //the highest level of the sections so far, the larger the lower
 	for _, chunk := range inputChunks {
-		keywordChunk, ok := chunk.(*KeywordChunk)
+		if sectionChunk := getSectionChunk(chunk); sectionChunk != nil && (topLevel == 0 || sectionChunk.Level <= topLevel) {
+			topLevel = sectionChunk.Level
+			if doc.options.FootnotesPerSection {
+				doc.footnotes = append(doc.footnotes, footnoteGroup{section: sectionChunk})
+			}
+		}
+		tree, err := BuildTree([]Chunk{chunk})
+		if err != nil {
+			return nil, err
+		}
+		group := &doc.footnotes[len(doc.footnotes)-1]
+		Inspect(tree, func(node Node) bool {
+			if footnoteNode, ok := node.(*FootnoteNode); ok {
+				count++
+				group.footnotes = append(group.footnotes, footnoteNode.Footnote)
+				footnoteNode.Footnote.Id = "footnote-" + strconv.Itoa(count)
+				footnoteNode.Footnote.Number = len(group.footnotes)
+			}
+			return true
+		})
+	}
+	return inputChunks, nil
+}
+
+//CiteChunkHandle numbers the cited entries of the bibliography in the order of first citation.
+//A key not in the bibliography is reported in the same way as \k referring to an unknown id.
+func (doc *Doc) CiteChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+	tree, err := BuildTree(inputChunks)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		number      int
+		diagnostics DiagnosticList
+	)
+	Inspect(tree, func(node Node) bool {
+		citeNode, ok := node.(*CiteNode)
 		if !ok {
-			outputChunks = append(outputChunks, chunk)
-			continue
+			return true
 		}
-		if gChunkWithCaptionMap[keywordChunk.Keyword] {
-			chunkWithIdCaption := keywordChunk.Children[0].(WithIdCaption)
-			idToChunk[chunkWithIdCaption.GetId()] = chunk
-			outputChunks = append(outputChunks, chunk)
+		citeNode.Cite.Entries = nil
+		for _, key := range citeNode.Cite.Keys {
+			entry := doc.bibEntries[key]
+			if entry == nil {
+				diagnostics.add(doc.warn(newDiagnostic(citeNode.Keyword, fmt.Errorf("%w %q: not in the bibliography", errUnknownReference, key))))
+			} else if entry.Number == 0 {
+				number++
+				entry.Number = number
+			}
+			citeNode.Cite.Entries = append(citeNode.Cite.Entries, entry)
+		}
+		return true
+	})
+	return inputChunks, diagnostics.err()
+}
+
+//TexChunkHandle converts the formulas of \t and \tex to MathML, unless they are left to MathJax by Options.MathJax.
+//The tex not supported by the converter is reported as warnings, and drawn as errors in the formulas.
+func (doc *Doc) TexChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+	if doc.options.MathJax {
+		return inputChunks, nil
+	}
+	tree, err := BuildTree(inputChunks)
+	if err != nil {
+		return nil, err
+	}
+	var diagnostics DiagnosticList
+	Inspect(tree, func(node Node) bool {
+		var (
+			keyword *KeywordChunk
+			errs    []error
+		)
+		switch n := node.(type) {
+		case *InlineTexNode:
+			keyword = n.Keyword
+			n.Tex.MathML, errs = texToMathML(n.Tex.Value, false)
+		case *BlockTexNode:
+			keyword = n.Keyword
+			n.Tex.MathML, errs = texToMathML(n.Tex.Value, true)
+		}
+		for _, err := range errs {
+			diagnostics.add(doc.warn(newDiagnostic(keyword, err)))
+		}
+		return true
+	})
+	return inputChunks, diagnostics.err()
+}
+
+//footnoteGroup is the footnotes numbered together, and listed at the end of the section, or of the document if section is nil
+type footnoteGroup struct {
+	section   *SectionChunk
+	footnotes []*FootnoteChunk
+}
+
+//FootnoteListHandle puts the lists of footnotes numbered by FootnoteChunkHandle at the end of the document or the top level sections.
+//It runs after the sections are nested. The footnotes before the first section are listed before it, if they are numbered per section.
+func (doc *Doc) FootnoteListHandle(inputChunks []Chunk) ([]Chunk, error) {
+	outputChunks := inputChunks
+	for _, group := range doc.footnotes {
+		if len(group.footnotes) == 0 {
 			continue
 		}
-		if keywordChunk.Keyword == CaptionKeyword {
-			captionChunks = append(captionChunks, chunk)
+		type item struct {
+			*FootnoteChunk
+			Content string //rendered
+		}
+		var list []item
+		for _, footnote := range group.footnotes {
+			content, err := doc.inlineChunkListRender(footnote.Content)
+			if err != nil {
+				return inputChunks, err
+			}
+			list = append(list, item{footnote, content})
+		}
+		var buf bytes.Buffer
+		err := gFootnoteListTemplate.Execute(&buf, list)
+		if err != nil {
+			return inputChunks, err
+		}
+		listChunk := &RawTextChunk{Position: group.footnotes[len(group.footnotes)-1].GetPosition(), Value: buf.String()}
+
+		switch {
+		case group.section != nil:
+			group.section.Children = append(group.section.Children, listChunk)
+		case doc.options.FootnotesPerSection:
+			//before the first section
+			i := 0
+			for i < len(outputChunks) && getSectionChunk(outputChunks[i]) == nil {
+				i++
+			}
+			outputChunks = append(outputChunks[:i:i], append([]Chunk{listChunk}, outputChunks[i:]...)...)
+		default:
+			outputChunks = append(outputChunks, listChunk)
+		}
+	}
+	return outputChunks, nil
+}
+
+//CaptionChunkHandle filter the Caption chunk, and set caption to the chunk it refers to
+func CaptionChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+	outputChunks := []Chunk{}
+	captionChunks := []*KeywordChunk{}
+	for _, chunk := range inputChunks {
+		keywordChunk, ok := chunk.(*KeywordChunk)
+		if ok && keywordChunk.Keyword == CaptionKeyword {
+			captionChunks = append(captionChunks, keywordChunk)
 			continue
 		}
 		outputChunks = append(outputChunks, chunk)
 	}
 
+	tree, err := BuildTree(outputChunks)
+	if err != nil {
+		return nil, err
+	}
+	idToChunk := make(map[string]WithIdCaption)
+	Inspect(tree, func(node Node) bool {
+		if captionedNode, ok := node.(CaptionedNode); ok {
+			//the duplicate ids are reported by IdChunkHandle, the caption goes to the first one
+			if _, ok := idToChunk[captionedNode.Captioned().GetId()]; !ok {
+				idToChunk[captionedNode.Captioned().GetId()] = captionedNode.Captioned()
+			}
+		}
+		return true
+	})
+
+	var diagnostics DiagnosticList
 	for _, captionChunk := range captionChunks {
-		id := captionChunk.(*KeywordChunk).Children[0]
-		caption := captionChunk.(*KeywordChunk).Children[1]
+		if len(captionChunk.Children) < 2 {
+			diagnostics.add(newDiagnostic(captionChunk, errUnexpectedChunk))
+			continue
+		}
+		id := captionChunk.Children[0]
+		caption := captionChunk.Children[1]
 		chunk, ok := idToChunk[id.GetValue()]
 		if !ok {
-			log.Println("caption ", caption, "has not found Id", id.GetValue())
-			return nil, errExpectChunkWithId
+			diagnostics.add(newDiagnostic(captionChunk, fmt.Errorf("%w%s", errExpectChunkWithId, id.GetValue())))
+			continue
 		}
-		chunk.(*KeywordChunk).Children[0].(WithIdCaption).SetCaption(caption.GetValue())
+		chunk.SetCaption(caption.GetValue())
 	}
-	return outputChunks, nil
+	return outputChunks, diagnostics.err()
 }
 
 //IncludeChunkHandle filter the Include chunk, and import contents of the file it refers to
-func IncludeChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+func (doc *Doc) IncludeChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
 	outputChunks := []Chunk{}
+	var diagnostics DiagnosticList
 
 	for _, chunk := range inputChunks {
 		keywordChunk, ok := chunk.(*KeywordChunk)
@@ -308,44 +672,104 @@ func IncludeChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
 		}
 
 		//now it is include keyword, we first figure out the path of the included file.
-		//it is relative to the current file to be compiled or absolute path.
-		//Note: If the included file itself contains include keyword,
-		//it is still relative to the current file to be compiled(not the included file)
-		//Note: the implementation of include keyword has limitations.
-		//It is better the included content does not rely on chunks in other files. Otherwise, surprise may happens.
-		parentDir := filepath.Dir(gDoc.FilePath)
+		//it is relative to the file that contains the include keyword, or absolute path.
 		includedFileName := strings.Trim(keywordChunk.GetValue(), BlankChars)
-		absolutePath := false
-		if strings.HasPrefix(includedFileName, "/") || strings.HasPrefix(includedFileName, "\\") {
-			absolutePath = true
-		}
-		var parts []string
-		var includedFilePath string
-		if strings.Contains(includedFileName, "/") {
-			parts = strings.Split(includedFileName, "/")
-			if absolutePath {
-				includedFilePath = filepath.Join("/", filepath.Join(parts...))
-			} else {
-				includedFilePath = filepath.Join(parentDir, filepath.Join(parts...))
-			}
-		} else {
-			parts = strings.Split(includedFileName, "\\")
-			if absolutePath {
-				includedFilePath = filepath.Join("\\", filepath.Join(parts...))
-			} else {
-				includedFilePath = filepath.Join(parentDir, filepath.Join(parts...))
-			}
+		includedFilePath, err := doc.findIncludedFile("included file", includedFileName)
+		var includedChunks []Chunk
+		if err == nil {
+			//included file to chunks, there are re-cursive calls inside
+			includedChunks, err = doc.fileToChunks(includedFilePath)
+		}
+		if err == nil && len(keywordChunk.Children) > 0 {
+			//\include{file}{id} takes only the fragment with the id
+			includedChunks, err = selectFragment(includedChunks, keywordChunk.Children[0].GetValue())
 		}
-		//included file to chunks, there are re-cursive calls inside
-		includedChunks, err := fileToChunks(includedFilePath)
 		if err != nil {
-			log.Println(err)
-			return nil, err
+			if !diagnostics.add(newDiagnostic(keywordChunk, err)) || doc.tooManyErrors(diagnostics) {
+				return outputChunks, diagnostics
+			}
+			continue
 		}
 		outputChunks = append(outputChunks, includedChunks...)
 	}
 
-	return outputChunks, nil
+	return outputChunks, diagnostics.err()
+}
+
+//includePath returns the path of the included file name, dir is where the including file is.
+//Both / and \ are accepted as separator.
+func includePath(dir, name string) string {
+	absolutePath := false
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") {
+		absolutePath = true
+	}
+	var parts []string
+	if strings.Contains(name, "/") {
+		parts = strings.Split(name, "/")
+		if absolutePath {
+			return filepath.Join("/", filepath.Join(parts...))
+		}
+	} else {
+		parts = strings.Split(name, "\\")
+		if absolutePath {
+			return filepath.Join("\\", filepath.Join(parts...))
+		}
+	}
+	return filepath.Join(dir, filepath.Join(parts...))
+}
+
+//selectFragment returns the section with id(including its subsections), or the range of the anchor with id.
+//The range of an anchor ends at the next anchor or section.
+func selectFragment(chunks []Chunk, id string) ([]Chunk, error) {
+	for i, chunk := range chunks {
+		if sectionChunk := getSectionChunk(chunk); sectionChunk != nil && sectionChunk.Id == id {
+			end := i + 1
+			for ; end < len(chunks); end++ {
+				if next := getSectionChunk(chunks[end]); next != nil && next.Level <= sectionChunk.Level {
+					break
+				}
+			}
+			return chunks[i:end], nil
+		}
+		if anchorChunk := getAnchorChunk(chunk); anchorChunk != nil && anchorChunk.Id == id {
+			end := i + 1
+			for ; end < len(chunks); end++ {
+				if getSectionChunk(chunks[end]) != nil || getAnchorChunk(chunks[end]) != nil {
+					break
+				}
+			}
+			return chunks[i:end], nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", errFragmentNotFound, id)
+}
+
+//getAnchorChunk returns the AnchorChunk of \a, or nil if chunk is not an anchor
+func getAnchorChunk(chunk Chunk) *AnchorChunk {
+	keywordChunk, ok := chunk.(*KeywordChunk)
+	if !ok || keywordChunk.Keyword != AnchorBlock || len(keywordChunk.Children) == 0 {
+		return nil
+	}
+	anchorChunk, _ := keywordChunk.Children[0].(*AnchorChunk)
+	return anchorChunk
+}
+
+//findIncludedFile searches the directory of the including file first, and then Options.IncludePath in order.
+//If the file is not found, the error tells what the file is for(e.g. "included file") and every path that is tried.
+func (doc *Doc) findIncludedFile(what, name string) (string, error) {
+	dirs := append([]string{filepath.Dir(doc.currentFile())}, doc.options.IncludePath...)
+	var tried []string
+	for _, dir := range dirs {
+		path := includePath(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+		tried = append(tried, path)
+		if strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") {
+			break //absolute path is not searched in the directories
+		}
+	}
+	return "", fmt.Errorf("%s %q %w, tried: %s", what, name, errFileNotFound, strings.Join(tried, ", "))
 }
 
 //MetaChunkHandle turns the chunk that is PlainTextChunk in inputChunks to MetaCharChunks if any
@@ -358,6 +782,9 @@ func MetaChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
 		if plainTextChunk, ok := chunk.(*PlainTextChunk); ok {
 			subChunks, err := metaCharChunkHandle(plainTextChunk.GetValue())
 			if err != nil {
+				if diag, ok := err.(*Diagnostic); ok {
+					diag.Position += chunk.GetPosition()
+				}
 				return newChunks, err
 			}
 			for _, subChunk := range subChunks {
@@ -430,7 +857,7 @@ func metaCharChunkHandle(s string) ([]Chunk, error) {
 	// there are unhandled chunk
 	if buf.Len() > 0 {
 		if escaping {
-			return chunks, errors.New("come to the end, but it is still in escaping state")
+			return chunks, &Diagnostic{Position: len(s) - 1, Err: errors.New("come to the end, but it is still in escaping state")}
 		}
 		plainTextChunk := PlainTextChunk{Position: startPos, Value: buf.String()}
 		chunks = append(chunks, &plainTextChunk)
@@ -1,10 +1,16 @@
-package main
+package hairtail
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"html/template"
+	"math"
+	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -21,11 +27,14 @@ func TestParseChunks(t *testing.T) {
 		"tex.txt",
 		"include.txt",
 	}
-	gConfig.TemplateFile = "template.html"
+	tmpl, err := template.ParseFiles("template.html")
+	if err != nil {
+		t.Fatal(err)
+	}
 	for _, file := range inputFiles {
 		outputFilePath := filepath.Join("test", fmt.Sprintf("%s%s", strings.TrimSuffix(file, filepath.Ext(file)), ".html"))
 		inputFilePath := filepath.Join("test", file)
-		err := CompileFile(inputFilePath, outputFilePath)
+		err := CompileFile(inputFilePath, outputFilePath, Options{Template: tmpl})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -33,6 +42,103 @@ func TestParseChunks(t *testing.T) {
 
 }
 
+func TestCompile(t *testing.T) {
+	input := "\\title compile from reader\n\\h{intro} introduction\nsome text\n"
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{Language: "en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Doc.Title != "compile from reader" || !strings.Contains(result.Doc.SectionIndex, "#intro") {
+		t.Fatal(result.Doc)
+	}
+	if !strings.Contains(result.Content, "<p>some text\n</p>") {
+		t.Fatal(result.Content)
+	}
+
+	//each call starts from a fresh document
+	result, err = Compile(context.Background(), strings.NewReader("no title"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Doc.Title != "" || result.Doc.SectionIndex != "" {
+		t.Fatal(result.Doc)
+	}
+
+	_, err = Compile(context.Background(), strings.NewReader("\\e{unclosed"), Options{FilePath: "unclosed.txt"})
+	if diags, ok := err.(DiagnosticList); !ok || diags[0].File != "unclosed.txt" {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Compile(ctx, strings.NewReader(input), Options{})
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	//a keyword without a name falls back to the keyword, instead of exiting the process
+	doc := newDoc(Options{Language: "en"})
+	if name := doc.getKeywordName(TableKeyword); name != "Table" {
+		t.Fatal(name)
+	}
+	if name := doc.getKeywordName("kbd"); name != "kbd" {
+		t.Fatal(name)
+	}
+}
+
+//it is expected to be run with -race
+func TestCompileConcurrently(t *testing.T) {
+	inputFiles := []string{"index.txt", "meta.txt", "section.txt", "include.txt"}
+	languages := []string{"cn", "en"}
+
+	expected := make(map[string]string)
+	for _, file := range inputFiles {
+		for _, language := range languages {
+			result, err := compileTestFile(file, language)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected[file+language] = result.Content
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(inputFiles)*len(languages)*4)
+	for i := 0; i < 4; i++ {
+		for _, file := range inputFiles {
+			for _, language := range languages {
+				wg.Add(1)
+				go func(file, language string) {
+					defer wg.Done()
+					result, err := compileTestFile(file, language)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if result.Content != expected[file+language] {
+						errs <- fmt.Errorf("%s(%s) compiled differently when compiling concurrently", file, language)
+					}
+				}(file, language)
+			}
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func compileTestFile(file, language string) (*Result, error) {
+	inputFilePath := filepath.Join("test", file)
+	input, err := os.Open(inputFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	return Compile(context.Background(), input, Options{FilePath: inputFilePath, Language: language})
+}
+
 func TestRawTextChunkHandle(t *testing.T) {
 	var text string
 	var err error
@@ -52,9 +158,9 @@ func TestRawTextChunkHandle(t *testing.T) {
 	values := []string{"abc", "raw", "def"}
 	positions := []int{0, 6, 10}
 	types := []string{
-		"*main.PlainTextChunk",
-		"*main.RawTextChunk",
-		"*main.PlainTextChunk",
+		"*hairtail.PlainTextChunk",
+		"*hairtail.RawTextChunk",
+		"*hairtail.PlainTextChunk",
 	}
 	for i := 0; i < 3; i++ {
 		chunk = chunkList[i]
@@ -92,11 +198,11 @@ func TestRawTextChunkHandle(t *testing.T) {
 	values = []string{"1", "aaa", "2", "bbb", "3"}
 	positions = []int{0, 5, 9, 15, 19}
 	types = []string{
-		"*main.PlainTextChunk",
-		"*main.RawTextChunk",
-		"*main.PlainTextChunk",
-		"*main.RawTextChunk",
-		"*main.PlainTextChunk",
+		"*hairtail.PlainTextChunk",
+		"*hairtail.RawTextChunk",
+		"*hairtail.PlainTextChunk",
+		"*hairtail.RawTextChunk",
+		"*hairtail.PlainTextChunk",
 	}
 	for i := 0; i < 5; i++ {
 		chunk = chunkList[i]
@@ -187,13 +293,13 @@ func TestMetaCharChunkHandle(t *testing.T) {
 	values := []string{"aa ", `\`, "emphasis", "{", "param", "}", " content"}
 	positions := []int{0, 3, 4, 12, 13, 18, 19}
 	types := []string{
-		"*main.PlainTextChunk",
-		"*main.MetaCharChunk",
-		"*main.PlainTextChunk",
-		"*main.MetaCharChunk",
-		"*main.PlainTextChunk",
-		"*main.MetaCharChunk",
-		"*main.PlainTextChunk",
+		"*hairtail.PlainTextChunk",
+		"*hairtail.MetaCharChunk",
+		"*hairtail.PlainTextChunk",
+		"*hairtail.MetaCharChunk",
+		"*hairtail.PlainTextChunk",
+		"*hairtail.MetaCharChunk",
+		"*hairtail.PlainTextChunk",
 	}
 	for i := 0; i < 7; i++ {
 		chunk = chunkList[i]
@@ -221,3 +327,1162 @@ func TestMetaCharChunkHandle(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestParseChunksDiagnostic(t *testing.T) {
+	_, err := newDoc(Options{}).ParseChunks("first line\nsecond \\e{unclosed")
+	diags, ok := err.(DiagnosticList)
+	if !ok || len(diags) != 1 {
+		t.Fatal("expect one Diagnostic, got", err)
+	}
+	diag := diags[0]
+	if !errors.Is(err, errExpectRBrace) {
+		t.Fatal(err)
+	}
+	if diag.Line != 2 || diag.Column != 9 || diag.Keyword != EmphasisFormat {
+		t.Fatal(diag)
+	}
+	if diag.Excerpt != "second \\e{unclosed\n        ^" {
+		t.Fatal(diag.Excerpt)
+	}
+
+	_, err = newDoc(Options{}).ParseChunks("\t\\nosuchkeyword{}")
+	diags, ok = err.(DiagnosticList)
+	if !ok || len(diags) != 1 || !errors.Is(diags[0], errNotImplemented) {
+		t.Fatal(err)
+	}
+	diag = diags[0]
+	if diag.Line != 1 || diag.Column != 3 || diag.Excerpt != "\t\\nosuchkeyword{}\n\t ^" {
+		t.Fatal(diag)
+	}
+}
+
+func TestParseChunksRecovery(t *testing.T) {
+	input := `\table{}{a \d b
+\e{x}
+}
+\nosuchkeyword{skipped}{skipped} text after
+\caption{no-such-id}{caption}
+
+\e unbalanced
+
+\ul{}{}
+\s{fine}`
+	chunks, err := newDoc(Options{}).ParseChunks(input)
+	diags, ok := err.(DiagnosticList)
+	if !ok {
+		t.Fatal("expect DiagnosticList, got", err)
+	}
+	lines := []int{1, 4, 7, 9, 5}
+	if len(diags) != len(lines) {
+		t.Fatal(err)
+	}
+	for i, line := range lines {
+		if diags[i].Line != line {
+			t.Fatal(i, diags[i])
+		}
+	}
+	//the text after the ill-formed keywords is still parsed
+	last, ok := chunks[len(chunks)-1].(*KeywordChunk)
+	if !ok || last.Keyword != StrongFormat {
+		t.Fatal(chunks)
+	}
+
+	_, err = newDoc(Options{MaxErrors: 2}).ParseChunks(input)
+	if diags, ok := err.(DiagnosticList); !ok || len(diags) != 2 {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildTree(t *testing.T) {
+	input := `\title tree
+\h{first} first
+
+some \e{text}
+
+\ul{u1}{
+\- item
+}
+\table{t1}{a \d b}
+
+more text`
+	chunks, err := newDoc(Options{}).ParseChunks(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := BuildTree(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	Inspect(tree, func(node Node) bool {
+		if node == nil {
+			return false
+		}
+		counts[reflect.TypeOf(node).String()]++
+		if node != tree && node.Parent() == nil {
+			t.Fatal("no parent", node)
+		}
+		return true
+	})
+	expect := map[string]int{
+		"*hairtail.DocumentNode":  1,
+		"*hairtail.MetaNode":      1,
+		"*hairtail.SectionNode":   1,
+		"*hairtail.ParagraphNode": 3, //two paragraphs of text, and one in the list item
+		"*hairtail.ListNode":      1,
+		"*hairtail.ListItemNode":  1,
+		"*hairtail.TableNode":     1,
+		"*hairtail.TableRowNode":  1,
+		"*hairtail.TableCellNode": 2,
+	}
+	for typ, count := range expect {
+		if counts[typ] != count {
+			t.Fatal(typ, counts)
+		}
+	}
+
+	//ill-formed chunks are reported instead of panic
+	_, err = BuildTree([]Chunk{&KeywordChunk{Keyword: BulletList}})
+	if !errors.Is(err, errUnexpectedChunk) {
+		t.Fatal(err)
+	}
+	//the keywords out of place are reported by name
+	_, err = newDoc(Options{}).ParseChunks(`a \span{2} b`)
+	if !errors.Is(err, errUnexpectedChunk) || !strings.Contains(err.Error(), `\span is only allowed inside \table or \chart`) ||
+		strings.Contains(err.Error(), "Chunk{") {
+		t.Fatal(err)
+	}
+}
+
+func TestSectionNestHandle(t *testing.T) {
+	input := `before
+\h{a} a
+in a
+\h2{a1} a1
+in a1
+\h3{a11} a11
+\h2{a2} a2
+\h{b} b
+in b`
+	chunks, err := newDoc(Options{}).ParseChunks(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := BuildTree(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//id of every section, followed by ids of its parent sections
+	var paths []string
+	Inspect(tree, func(node Node) bool {
+		sectionNode, ok := node.(*SectionNode)
+		if !ok {
+			return true
+		}
+		path := sectionNode.Section.Id
+		for parent := node.Parent(); parent != nil; parent = parent.Parent() {
+			if parentSection, ok := parent.(*SectionNode); ok {
+				path += "<" + parentSection.Section.Id
+			}
+		}
+		paths = append(paths, path)
+		return true
+	})
+	expect := []string{"a", "a1<a", "a11<a1<a", "a2<a", "b"}
+	if !reflect.DeepEqual(paths, expect) {
+		t.Fatal(paths)
+	}
+
+	//nesting again gives the same result
+	nested, err := SectionNestHandle(chunks)
+	if err != nil || !reflect.DeepEqual(nested, chunks) {
+		t.Fatal(nested, err)
+	}
+}
+
+//parseKeywords runs the passes up to KeywordChunkHandle
+func parseKeywords(input string) ([]Chunk, error) {
+	chunks, err := RawTextChunkHandle(input)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err = MetaChunkHandle(chunks)
+	if err != nil {
+		return nil, err
+	}
+	return newDoc(Options{}).KeywordChunkHandle(chunks)
+}
+
+func TestKeywordBlanks(t *testing.T) {
+	//every input is expected to give the keyword, with the id if the keyword has one
+	cases := []struct {
+		input, keyword, id string
+	}{
+		{"\\e {x}", EmphasisFormat, ""},
+		{"\\s\n{x}", StrongFormat, ""},
+		{"\\w {http://a.b} \n\t{text}", HyperLink, ""},
+		{"\\c \n{x}", InlineCode, ""},
+		{"\\c \\r#{x}#", InlineCode, ""},
+		{"\\t\n \\r#{x^2}#", InlineTex, ""},
+		{"\\-- {x}", CommentKeyword, ""},
+		{"\\a { top }\n{top of article}", AnchorBlock, "top"},
+		{"\\k {\n top\n}", ReferToBlock, "top"},
+		{"\\image {img} \n {a.png}", ImageKeyword, "img"},
+		{"\\caption {img}\n{caption}", CaptionKeyword, "img"},
+		{"\\code {code} {fmt.Println()}", BlockCode, "code"},
+		{"\\code{code}\n\\r#{fmt.Println()}#", BlockCode, "code"},
+		{"\\tex {math}\n \\r#{x^2}#", BlockTex, "math"},
+		{"\\h {intro} introduction", SectionHeader, "intro"},
+		{"\\h6\t{ intro } introduction", SectionHeader6, "intro"},
+		{"\\ol {list}\n{\n\\- a\n}", OrderList, "list"},
+		{"\\ul{list} {\\- a}", BulletList, "list"},
+		{"\\table {tbl}\n{a \\d b}", TableKeyword, "tbl"},
+		{"\\title   meta data", TitleKeyword, ""},
+		{"\\toc \n", SectionIndexKeyword, ""},
+	}
+	for _, c := range cases {
+		chunks, err := parseKeywords(c.input)
+		if err != nil {
+			t.Fatalf("%q %v", c.input, err)
+		}
+		keywordChunk, ok := chunks[0].(*KeywordChunk)
+		if !ok || keywordChunk.Keyword != c.keyword {
+			t.Fatalf("%q %v", c.input, chunks)
+		}
+		if c.id == "" {
+			continue
+		}
+		var id string
+		switch child := keywordChunk.Children[0].(type) {
+		case *AnchorChunk:
+			id = child.Id
+		case *ReferToChunk:
+			id = child.Id
+		case *SectionChunk:
+			id = child.Id
+		case WithIdCaptionNumbering:
+			id = child.GetId()
+		default:
+			id = child.GetValue() //id of caption
+		}
+		if id != c.id {
+			t.Fatalf("%q %q", c.input, id)
+		}
+	}
+
+	errorCases := []struct {
+		input string
+		err   error
+	}{
+		{"\\e\n\n{x}", errUnexpectedBlank},
+		{"\\h\n\n{intro} introduction", errUnexpectedBlank},
+		{"\\image{img}\n \n{a.png}", errUnexpectedBlank},
+		{"\\c \r\n\r\n\\r#{x}#", errUnexpectedBlank},
+		{"\\tex{math}\n\n\\r#{x^2}#", errUnexpectedBlank},
+		{"\\ e{x}", errExpectToken},
+		{"\\k{two ids}", errExpectToken},
+	}
+	for _, c := range errorCases {
+		_, err := parseKeywords(c.input)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("%q %v", c.input, err)
+		}
+	}
+}
+
+func TestRegisterKeyword(t *testing.T) {
+	t.Cleanup(func() {
+		unregisterKeyword("kbd")
+		unregisterKeyword("note")
+	})
+	err := RegisterKeyword(&KeywordHandler{
+		Keyword: "kbd",
+		Args:    []ArgKind{BlockArg},
+		Inline:  true,
+		Render: func(doc *Doc, keywordChunk *KeywordChunk) (string, error) {
+			text, err := doc.ChunkListRender(keywordChunk.Args[0])
+			return "<kbd>" + text + "</kbd>", err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegisterKeyword(&KeywordHandler{
+		Keyword: "note",
+		Args:    []ArgKind{TokenArg, RestOfLineArg},
+		Render: func(doc *Doc, keywordChunk *KeywordChunk) (string, error) {
+			return fmt.Sprintf(`<div class="note" id="%s">%s</div>`, keywordChunk.Args[0][0].GetValue(), keywordChunk.Value), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := "press \\kbd{Ctrl \\s{C}} to copy\n\n\\note {n1} be careful\nnext"
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"<p>press <kbd>Ctrl <strong>C</strong></kbd> to copy", `<div class="note" id="n1">be careful</div>`, "<p>next</p>"} {
+		if !strings.Contains(result.Content, expect) {
+			t.Fatal(expect, result.Content)
+		}
+	}
+
+	chunks, err := newDoc(Options{}).ParseChunks(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := BuildTree(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tree.Children()[1].(*CustomNode); !ok {
+		t.Fatal(tree.Children())
+	}
+
+	render := func(doc *Doc, keywordChunk *KeywordChunk) (string, error) { return "", nil }
+	if err := RegisterKeyword(&KeywordHandler{Keyword: EmphasisFormat, Render: render}); !errors.Is(err, errKeywordRegistered) {
+		t.Fatal(err)
+	}
+	if err := RegisterKeyword(&KeywordHandler{Keyword: "two words", Render: render}); !errors.Is(err, errInvalidKeyword) {
+		t.Fatal(err)
+	}
+	if err := RegisterKeyword(&KeywordHandler{Keyword: "line", Args: []ArgKind{RestOfLineArg, TokenArg}, Render: render}); !errors.Is(err, errInvalidKeyword) {
+		t.Fatal(err)
+	}
+}
+
+func TestMacroChunkHandle(t *testing.T) {
+	input := `\def{product}{\w{https://example.com/#1}{Product #1}}
+\def{warn}{\s{warning:} #1 #2#1}
+see \product{one}. \warn{a}{\product{b}}`
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `see <a href="https://example.com/one">Product one</a>. <strong>warning:</strong> a <a href="https://example.com/b">Product b</a>a`
+	if !strings.Contains(result.Content, expect) {
+		t.Fatal(result.Content)
+	}
+
+	//errors refer to where the text is written, either in the definition or in the call
+	input = `\def{loop}{x \again}
+\def{again}{\loop}
+\def{em}{\e{#1}}
+\loop
+
+\em{\nosuchkeyword}
+
+\def{e}{redefined}`
+	_, err = newDoc(Options{}).ParseChunks(input)
+	diags, ok := err.(DiagnosticList)
+	if !ok || len(diags) != 3 {
+		t.Fatal(err)
+	}
+	if !errors.Is(diags[0], errMacroRecursion) || diags[0].Line != 2 || diags[0].Column != 14 {
+		t.Fatal(diags[0])
+	}
+	if !errors.Is(diags[1], errMacroIsKeyword) || diags[1].Line != 8 {
+		t.Fatal(diags[1])
+	}
+	if !errors.Is(diags[2], errNotImplemented) || diags[2].Line != 6 || diags[2].Column != 6 {
+		t.Fatal(diags[2])
+	}
+}
+
+//writeTestFiles writes the files of a test into dir, by the paths relative to dir
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIncludeChunkHandle(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.txt":   "main\n\n\\include sub/a.txt\n",
+		"sub/a.txt":  "text of a\n\n\\include b.txt\n",
+		"sub/b.txt":  "text of b\n",
+		"c1.txt":     "\\include sub/c2.txt\n",
+		"sub/c2.txt": "c2\n\n\\include ../c1.txt\n",
+	}
+	writeTestFiles(t, dir, files)
+
+	//included files are relative to the file that includes them
+	out := filepath.Join(dir, "main.html")
+	if err := CompileFile(filepath.Join(dir, "main.txt"), out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "text of a") || !strings.Contains(string(content), "text of b") {
+		t.Fatal(string(content))
+	}
+
+	//the cycle is reported at the include that closes it, with the whole chain
+	err = CompileFile(filepath.Join(dir, "c1.txt"), out, Options{})
+	if !errors.Is(err, errIncludeCycle) {
+		t.Fatal(err)
+	}
+	var diag *Diagnostic
+	if !errors.As(err, &diag) || diag.File != filepath.Join(dir, "sub/c2.txt") || diag.Line != 3 {
+		t.Fatal(err)
+	}
+	chain := filepath.Join(dir, "c1.txt") + " -> " + filepath.Join(dir, "sub/c2.txt") + " -> " + filepath.Join(dir, "c1.txt")
+	if !strings.Contains(err.Error(), chain) {
+		t.Fatal(err)
+	}
+
+	//the problems found after the files are included are located in the included file
+	files = map[string]string{
+		"warn.txt":       "\\h{top} top\n\n\\include sub/warn-a.txt\n",
+		"sub/warn-a.txt": "\\h2{top} top again\nsee \\k{missing-in-a}\n",
+	}
+	writeTestFiles(t, dir, files)
+	opts := Options{FilePath: filepath.Join(dir, "warn.txt")}
+	result, err := Compile(context.Background(), strings.NewReader(files["warn.txt"]), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Warnings) != 2 {
+		t.Fatal(result.Warnings)
+	}
+	lines := strings.Split(files["sub/warn-a.txt"], "\n")
+	for i, warning := range result.Warnings {
+		if warning.File != filepath.Join(dir, "sub/warn-a.txt") || warning.Line != i+1 || !strings.HasPrefix(warning.Excerpt, lines[i]) {
+			t.Fatal(warning)
+		}
+	}
+	if related := result.Warnings[0].Related; related == nil || related.File != opts.FilePath || related.Line != 1 {
+		t.Fatal(result.Warnings[0])
+	}
+}
+
+func TestIncludePath(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"doc/main.txt":      "\\include legal.txt\n\n\\include glossary.txt\n",
+		"doc/legal.txt":     "local legal\n",
+		"lib1/legal.txt":    "shared legal\n",
+		"lib2/glossary.txt": "shared glossary\n",
+		"doc/missing.txt":   "\\include nosuchfile.txt\n",
+	}
+	writeTestFiles(t, dir, files)
+	opts := Options{IncludePath: []string{filepath.Join(dir, "lib1"), filepath.Join(dir, "lib2")}}
+
+	//the directory of the including file goes first, and then the include path in order
+	out := filepath.Join(dir, "main.html")
+	if err := CompileFile(filepath.Join(dir, "doc/main.txt"), out, opts); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "local legal") || strings.Contains(string(content), "shared legal") ||
+		!strings.Contains(string(content), "shared glossary") {
+		t.Fatal(string(content))
+	}
+
+	//every path tried is reported
+	err = CompileFile(filepath.Join(dir, "doc/missing.txt"), out, opts)
+	if !errors.Is(err, errFileNotFound) {
+		t.Fatal(err)
+	}
+	for _, tried := range []string{"doc", "lib1", "lib2"} {
+		if !strings.Contains(err.Error(), filepath.Join(dir, tried, "nosuchfile.txt")) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIncludeFragment(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.txt": "\\h{intro} intro\n\n\\include{other.txt}{install}\n\n\\include {other.txt} {note}\n\n\\include{other.txt}{nosuchid}\n",
+		"other.txt": "\\h{skipped} skipped\n\n\\h{install} install\nhow to install\n\\h2{linux} linux\non linux\n\\h{usage} usage\nskipped too\n\n" +
+			"\\a{note}{} the note\n\nsecond paragraph of note\n\\a{note-end}{} skipped again\n",
+	}
+	writeTestFiles(t, dir, files)
+	err := CompileFile(filepath.Join(dir, "main.txt"), filepath.Join(dir, "main.html"), Options{})
+	if !errors.Is(err, errFragmentNotFound) {
+		t.Fatal(err)
+	}
+
+	files["main.txt"] = strings.Replace(files["main.txt"], "\\include{other.txt}{nosuchid}", "", 1)
+	result, err := Compile(context.Background(), strings.NewReader(files["main.txt"]), Options{FilePath: filepath.Join(dir, "main.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"2 install", "how to install", "2.1 linux", "on linux", "the note", "second paragraph of note"} {
+		if !strings.Contains(result.Content, expect) {
+			t.Fatal(expect, result.Content)
+		}
+	}
+	for _, unexpected := range []string{"skipped", "usage"} {
+		if strings.Contains(result.Content, unexpected) {
+			t.Fatal(unexpected, result.Content)
+		}
+	}
+	//the spliced sections are in the index of the document
+	if !strings.Contains(result.Doc.SectionIndex, "install") || !strings.Contains(result.Doc.SectionIndex, "linux") {
+		t.Fatal(result.Doc.SectionIndex)
+	}
+}
+
+func TestCompileBuild(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"intro.txt":         "\\h{intro} intro\n\nsee \\k{guide/install.txt#linux}, \\k{setup} and \\k{intro}\n",
+		"guide/install.txt": "\\h{install} install\n\n\\h2{linux} linux\n\n\\a{setup}{setup} back to \\k{../intro.txt#intro}\n",
+		"dup.txt":           "\\h{linux} linux again\n\nsee \\k{linux}\n",
+	}
+	writeTestFiles(t, dir, files)
+	buildFiles := []BuildFile{
+		{InputFile: filepath.Join(dir, "intro.txt"), OutputFile: filepath.Join(dir, "html/intro.html")},
+		{InputFile: filepath.Join(dir, "guide/install.txt"), OutputFile: filepath.Join(dir, "html/guide/install.html")},
+	}
+	results, err := CompileBuild(context.Background(), buildFiles, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{`href="guide/install.html#linux"`, `href="guide/install.html#setup"`, `href="#intro"`} {
+		if !strings.Contains(results[0].Content, expect) {
+			t.Fatal(expect, results[0].Content)
+		}
+	}
+	if !strings.Contains(results[1].Content, `href="../intro.html#intro"`) {
+		t.Fatal(results[1].Content)
+	}
+
+	//an id defined in the same file goes first, an id defined in more than one other file is ambiguous
+	buildFiles = append(buildFiles, BuildFile{InputFile: filepath.Join(dir, "dup.txt"), OutputFile: filepath.Join(dir, "html/dup.html")})
+	results, err = CompileBuild(context.Background(), buildFiles, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(results[2].Content, `href="#linux"`) {
+		t.Fatal(results[2].Content)
+	}
+	files["intro.txt"] = "see \\k{linux}\n\nsee \\k{nosuchfile.txt#linux}\n"
+	if err := os.WriteFile(buildFiles[0].InputFile, []byte(files["intro.txt"]), 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err = CompileBuild(context.Background(), buildFiles, Options{Strict: true})
+	if !errors.Is(err, errAmbiguousReference) || !errors.Is(err, errUnknownReference) {
+		t.Fatal(err)
+	}
+
+	//a single document does not refer to other files
+	_, err = Compile(context.Background(), strings.NewReader(files["intro.txt"]), Options{Strict: true})
+	if !errors.Is(err, errUnknownReference) {
+		t.Fatal(err)
+	}
+
+	//two documents are not written to the same file
+	buildFiles[1].OutputFile = buildFiles[0].OutputFile
+	_, err = CompileBuild(context.Background(), buildFiles, Options{})
+	if !errors.Is(err, errDuplicateOutput) {
+		t.Fatal(err)
+	}
+}
+
+func TestIdChunkHandle(t *testing.T) {
+	input := `\h{intro} intro
+
+\a{intro}{again} see \k{intro}, \k{nosuchid}
+
+\code{sample}{ a }
+
+\code{sample}{ b }
+\caption{sample}{the sample}
+`
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Warnings) != 3 {
+		t.Fatal(result.Warnings)
+	}
+	//both definitions of a duplicate id are reported
+	for i, line := range []int{3, 7, 3} {
+		warning := result.Warnings[i]
+		if warning.Line != line {
+			t.Fatal(warning)
+		}
+		if i < 2 && (!errors.Is(warning, errDuplicateId) || warning.Related == nil || warning.Related.Line != line-2) {
+			t.Fatal(warning)
+		}
+	}
+	if !errors.Is(result.Warnings[2], errUnknownReference) {
+		t.Fatal(result.Warnings[2])
+	}
+	//the caption goes to the first definition
+	if !strings.Contains(result.Content, "the sample") || strings.Count(result.Content, "the sample") != 1 {
+		t.Fatal(result.Content)
+	}
+
+	_, err = Compile(context.Background(), strings.NewReader(input), Options{Strict: true})
+	if !errors.Is(err, errDuplicateId) {
+		t.Fatal(err)
+	}
+}
+
+func TestReferText(t *testing.T) {
+	input := `\h{intro} intro
+
+\a{note}{the note} \a{mark}{}
+
+\table{tbl1}{ a \d b }
+\caption{tbl1}{the table}
+
+\code{code1}{ a }
+
+see \k{intro}, \k{note}, \k{mark}, \k{tbl1}, \k{code1} and \k{tbl1}{this table}.
+`
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{Language: "en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{`href="#intro">1 intro</a>`, `href="#note">the note</a>`, `href="#mark">mark</a>`,
+		`href="#tbl1">Table 1</a>`, `href="#code1">Code</a>`, `href="#tbl1">this table</a>`} {
+		if !strings.Contains(result.Content, expect) {
+			t.Fatal(expect, result.Content)
+		}
+	}
+
+	//the text is plain text, a keyword in it is not dropped silently
+	_, err = Compile(context.Background(), strings.NewReader(`\a{note}{the note} see \k{note}{the \e{first} note}`), Options{})
+	var diag *Diagnostic
+	if !errors.Is(err, errExpectPlainText) || !errors.As(err, &diag) || diag.Keyword != ReferToBlock {
+		t.Fatal(err)
+	}
+}
+
+func TestTermLess(t *testing.T) {
+	//'#' goes first, then the English and Chinese terms grouped by the initial letter
+	terms := []string{"2d", "apple", "Apples", "安装", "bear", "编辑", "编译器", "hairtail", "中文"}
+	for i := 0; i+1 < len(terms); i++ {
+		if !termLess(terms[i], terms[i+1]) || termLess(terms[i+1], terms[i]) {
+			t.Fatal(terms[i], terms[i+1])
+		}
+	}
+	if termInitial("安装") != 'A' || termInitial("中文") != 'Z' || termInitial("hairtail") != 'H' || termInitial("2d") != '#' {
+		t.Fatal(termInitial("安装"), termInitial("中文"))
+	}
+
+	//the hanzi out of GB2312 level 1, traditional hanzi and accented Latin letters are not grouped under '#'
+	for term, initial := range map[string]rune{"鑫": 'X', "華為": 'H', "Ärger": 'A', "éclair": 'E', "Ōsaka": 'O'} {
+		if termInitial(term) != initial {
+			t.Fatal(term, string(termInitial(term)))
+		}
+	}
+	terms = []string{"Ärger", "art", "éclair", "editor", "华为", "華為", "画", "新", "鑫"}
+	for i := 0; i+1 < len(terms); i++ {
+		if !termLess(terms[i], terms[i+1]) || termLess(terms[i+1], terms[i]) {
+			t.Fatal(terms[i], terms[i+1])
+		}
+	}
+}
+
+func TestIndexTermChunkHandle(t *testing.T) {
+	input := `\index
+
+\h{intro} intro
+hairtail\i{hairtail} \i{编译器} \i{安装}
+
+\h2{usage} usage
+\i{hairtail}{grammar} \i{ apple }
+`
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `<div class="term-index">
+<p class="term-index-group"><strong>A</strong></p>
+<p class="term-index-entry">apple <a href="#index-term-5">1.1</a></p>
+<p class="term-index-entry">安装 <a href="#index-term-3">1</a></p>
+<p class="term-index-group"><strong>B</strong></p>
+<p class="term-index-entry">编译器 <a href="#index-term-2">1</a></p>
+<p class="term-index-group"><strong>H</strong></p>
+<p class="term-index-entry">hairtail <a href="#index-term-1">1</a></p>
+<p class="term-index-subentry">grammar <a href="#index-term-4">1.1</a></p>
+</div>
+`
+	if result.Doc.TermIndex != expect || !strings.HasPrefix(result.Content, expect) {
+		t.Fatal(result.Doc.TermIndex)
+	}
+	if !strings.Contains(result.Content, `hairtail<a id="index-term-1" class="index-term"></a>`) {
+		t.Fatal(result.Content)
+	}
+}
+
+func TestFootnoteChunkHandle(t *testing.T) {
+	input := `before\f{zero}
+
+\h{one} one
+text\f{see \e{this}} and\f{\k{two}}
+
+\h2{sub} sub
+sub\f{in sub}
+
+\h{two} two
+text\f{last}
+`
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the marks stay in the paragraph, the list is at the end of the document
+	if !strings.Contains(result.Content, `text<sup class="footnote-ref"><a id="footnote-2-ref" href="#footnote-2">2</a></sup> and`) ||
+		!strings.HasSuffix(result.Content, `<p class="footnote" id="footnote-5"><a href="#footnote-5-ref">5</a> last</p>`+"\n</div>\n") ||
+		!strings.Contains(result.Content, `<a href="#footnote-2-ref">2</a> see <em>this</em></p>`) ||
+		!strings.Contains(result.Content, `<a href="#footnote-3-ref">3</a> <a class="referto" href="#two">2 two</a></p>`) {
+		t.Fatal(result.Content)
+	}
+
+	result, err = Compile(context.Background(), strings.NewReader(input), Options{FootnotesPerSection: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//numbered again in each top level section, the subsections share the list of their top level section
+	for _, expect := range []string{
+		`<div class="footnotes">` + "\n" + `<p class="footnote" id="footnote-1"><a href="#footnote-1-ref">1</a> zero</p>` + "\n</div>\n" + `<section class="section1">`,
+		`<a href="#footnote-4-ref">3</a> in sub</p>` + "\n</div>\n</section>\n",
+		`<a href="#footnote-5-ref">1</a> last</p>` + "\n</div>\n</section>\n",
+	} {
+		if !strings.Contains(result.Content, expect) {
+			t.Fatal(expect, result.Content)
+		}
+	}
+}
+
+func TestParseBibTeX(t *testing.T) {
+	entries, err := parseBibTeX(`% comment
+@string{acm = "ACM"}
+@Article{knuth84,
+  author = {Donald E. Knuth},
+  title  = {Literate {P}rogramming},
+  journal = "The Computer " # acm,
+  year = 1984
+}
+@book(lamport94, author = "Leslie Lamport and Some One and {Third} Person", title = {\LaTeX})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Type != "article" || entries[0].Key != "knuth84" || entries[1].Key != "lamport94" {
+		t.Fatal(entries)
+	}
+	if entries[0].Reference() != "Donald E. Knuth. <em>Literate Programming</em>. The Computer acm, 1984." {
+		t.Fatal(entries[0].Reference())
+	}
+	if entries[1].Authors() != "Leslie Lamport, Some One and Third Person" {
+		t.Fatal(entries[1].Authors())
+	}
+
+	_, err = parseBibTeX("@article{key,\n title = {unclosed}\n")
+	if !errors.Is(err, errBibTeXSyntax) || !strings.Contains(err.Error(), "line 3") {
+		t.Fatal(err)
+	}
+}
+
+func TestCiteChunkHandle(t *testing.T) {
+	dir := t.TempDir()
+	bib := "@book{b, title = {Book B}}\n@book{a, title = {Book A}}\n@book{c, title = {Not cited}}\n"
+	if err := os.WriteFile(filepath.Join(dir, "refs.bib"), []byte(bib), 0666); err != nil {
+		t.Fatal(err)
+	}
+	input := "see \\cite{a} and \\cite{b, a, nokey}\n\n\\bibliography{refs.bib}\n"
+	opts := Options{FilePath: filepath.Join(dir, "main.txt")}
+	result, err := Compile(context.Background(), strings.NewReader(input), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `<p>see [<a class="cite" href="#bib-a">1</a>] and [<a class="cite" href="#bib-b">2</a>, <a class="cite" href="#bib-a">1</a>, ?]</p>
+<div class="bibliography">
+<p class="reference" id="bib-a">[1] <em>Book A</em>.</p>
+<p class="reference" id="bib-b">[2] <em>Book B</em>.</p>
+</div>
+`
+	if result.Content != expect {
+		t.Fatal(result.Content)
+	}
+	//unknown keys are reported like unknown ids
+	if len(result.Warnings) != 1 || !errors.Is(result.Warnings[0], errUnknownReference) {
+		t.Fatal(result.Warnings)
+	}
+	opts.Strict = true
+	_, err = Compile(context.Background(), strings.NewReader(input), opts)
+	if !errors.Is(err, errUnknownReference) {
+		t.Fatal(err)
+	}
+
+	//a missing file is reported as the bibliography file, rather than an included file
+	_, err = Compile(context.Background(), strings.NewReader(`\bibliography{nosuch.bib}`), opts)
+	if !errors.Is(err, errFileNotFound) || !strings.Contains(err.Error(), `bibliography file "nosuch.bib" not found`) {
+		t.Fatal(err)
+	}
+}
+
+func TestTableOptions(t *testing.T) {
+	input := `\table{t}{header=1 align=-r}{
+name \d score
+henry \d 100
+}`
+	chunks, err := newDoc(Options{}).ParseChunks(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := chunks[0].(*KeywordChunk).Children[0].(*TableChunk)
+	if table.HeaderRows != 1 || table.Align(0) != AlignDefault || table.Align(1) != AlignRight || table.Align(2) != AlignDefault {
+		t.Fatal(table)
+	}
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "<thead>\n" + `<tr><th>name</th><th style="text-align:right">score</th></tr>` + "\n</thead>\n<tbody>\n" +
+		`<tr><td>henry</td><td style="text-align:right">100</td></tr>` + "\n</tbody>\n"
+	if !strings.Contains(result.Content, expect) {
+		t.Fatal(result.Content)
+	}
+
+	for _, input := range []string{`\table{t}{header=x}{a}`, `\table{t}{align=lx}{a}`, `\table{t}{width=1}{a}`, `\table{t}{header}{a}`} {
+		_, err := newDoc(Options{}).ParseChunks(input)
+		diags, ok := err.(DiagnosticList)
+		if !ok || len(diags) != 1 || diags[0].Column != 10 {
+			t.Fatal(input, err)
+		}
+	}
+}
+
+func TestTableRichCells(t *testing.T) {
+	input := `\h{intro} intro
+\table{t}{
+\e{bold} text \d \c{code} \d \w{http://a.b}{link}
+see \k{intro} \d \d \f{note}
+
+}`
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		`<tr><td><em>bold</em> text</td><td><code>code</code></td><td><a href="http://a.b">link</a></td></tr>`,
+		`<tr><td>see <a class="referto" href="#intro">1 intro</a></td><td></td><td><sup class="footnote-ref">`,
+	} {
+		if !strings.Contains(result.Content, expect) {
+			t.Fatal(expect, result.Content)
+		}
+	}
+}
+
+func TestTableSpan(t *testing.T) {
+	input := `\table{t}{align=lcr}{
+\span{2} name \d score
+\span{1}{2} henry \d math \d 100
+art \d 90
+}`
+	chunks, err := newDoc(Options{}).ParseChunks(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := chunks[0].(*KeywordChunk).Children[0].(*TableChunk)
+	//art is placed after the column spanned by henry
+	if table.Columns != 3 || len(table.Cells) != 3 || table.Cells[2][0].Column != 1 || table.Cells[2][1].Column != 2 {
+		t.Fatal(table)
+	}
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		`<tr><td colspan="2" style="text-align:left">name</td><td style="text-align:right">score</td></tr>`,
+		`<tr><td rowspan="2" style="text-align:left">henry</td>`,
+		`<tr><td style="text-align:center">art</td><td style="text-align:right">90</td></tr>`,
+	} {
+		if !strings.Contains(result.Content, expect) {
+			t.Fatal(expect, result.Content)
+		}
+	}
+
+	//a cell holds several lines and blocks if rows are ended by \tr only
+	input = `\table{t}{rows=explicit}{
+first
+second \d \ul{l}{
+\- item
+} \tr
+a \d b \tr
+}`
+	chunks, err = newDoc(Options{}).ParseChunks(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table = chunks[0].(*KeywordChunk).Children[0].(*TableChunk)
+	if len(table.Cells) != 2 || table.Cells[0][0].Value[0].GetValue() != "first\nsecond" || table.Cells[0][1].Value[0].(*KeywordChunk).Keyword != BulletList {
+		t.Fatal(table)
+	}
+
+	input = `\table{t}{
+a \d b
+c
+\span{1}{3} d \d e
+}`
+	_, err = newDoc(Options{}).ParseChunks(input)
+	diags, ok := err.(DiagnosticList)
+	if !ok || len(diags) != 2 || !errors.Is(diags[0], errRaggedTable) || diags[0].Line != 3 || diags[1].Line != 4 {
+		t.Fatal(err)
+	}
+	_, err = newDoc(Options{}).ParseChunks(`\table{t}{\span{0} a}`)
+	if !errors.Is(err, errInvalidTableSpan) {
+		t.Fatal(err)
+	}
+}
+
+func TestTableFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"data/m.csv":  "\ufeffname,unit,value\n\"len, total\",mm,12\nwidth,mm,3\n",
+		"data/m.tsv":  "a\tb\n1\t2\n",
+		"data/r.data": "a;b\n1\n",
+	})
+	input := `\caption{m}{measurements}
+\table{m}{file=data/m.csv header=1 columns=1,3}
+\table{n}{file=data/m.tsv}
+
+\table-index`
+	opts := Options{FilePath: filepath.Join(dir, "main.txt")}
+	result, err := Compile(context.Background(), strings.NewReader(input), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"<thead>\n<tr><th>name</th><th>value</th></tr>\n</thead>\n<tbody>\n<tr><td>len, total</td><td>12</td></tr>\n<tr><td>width</td><td>3</td></tr>\n</tbody>",
+		"<table><tr><td>a</td><td>b</td></tr>\n<tr><td>1</td><td>2</td></tr>\n</table>",
+		`<a href="#m">表格 1:  measurements</a>`,
+	} {
+		if !strings.Contains(result.Content, expect) {
+			t.Fatal(expect, result.Content)
+		}
+	}
+
+	for input, expect := range map[string]error{
+		`\table{r}{file=data/r.data delimiter=semicolon}`: errRaggedTable,
+		`\table{m}{file=data/m.csv columns=2-4}`:          errTableColumnNotFound,
+		`\table{m}{file=data/nosuch.csv}`:                 errFileNotFound,
+		`\table{m}{delimiter=tab}{a}`:                     errInvalidTableOption,
+	} {
+		_, err := Compile(context.Background(), strings.NewReader(input), opts)
+		if !errors.Is(err, expect) {
+			t.Fatal(input, err)
+		}
+	}
+	//a missing file is reported as the table file, rather than an included file
+	_, err = Compile(context.Background(), strings.NewReader(`\table{m}{file=data/nosuch.csv}`), opts)
+	if !strings.Contains(err.Error(), `table file "data/nosuch.csv" not found`) {
+		t.Fatal(err)
+	}
+}
+
+func TestChart(t *testing.T) {
+	input := `\caption{c1}{bugs}
+\chart{c1}{type=bar header=1}{
+week \d opened \d closed
+w1 \d 12 \d 8
+w2 \d \d -2
+}
+\caption{c2}{status}
+\chart{c2}{type=pie width=300 height=200}{
+done \d 6
+todo \d 2
+}
+\chart-index`
+	chunks, err := newDoc(Options{}).ParseChunks(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chart *ChartChunk
+	for _, chunk := range chunks {
+		if keywordChunk, ok := chunk.(*KeywordChunk); ok && keywordChunk.Keyword == ChartKeyword {
+			chart = keywordChunk.Children[0].(*ChartChunk)
+			break
+		}
+	}
+	if chart.Type != ChartBar || len(chart.Labels) != 2 || len(chart.Series) != 2 || chart.Series[1].Name != "closed" ||
+		chart.Series[1].Values[1] != -2 || !math.IsNaN(chart.Series[0].Values[1]) {
+		t.Fatal(chart)
+	}
+
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{Language: "en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		`<a id="c1" class="caption">Chart 1:  bugs</a>`,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="300" height="200" viewBox="0 0 300 200"`,
+		`<title>w2: -2</title></rect>`,
+		`<title>done 75.0%</title></path>`,
+		`<p><a href="#c2">Chart 2:  status</a></p>`,
+	} {
+		if !strings.Contains(result.Content, expect) {
+			t.Fatal(expect, result.Content)
+		}
+	}
+	//the empty cell has no bar
+	if n := strings.Count(result.Content, "</rect>"); n != 3 {
+		t.Fatal(n, result.Content)
+	}
+
+	for input, expect := range map[string]error{
+		`\chart{c}{type=area}{a \d 1}`:                   errUnknownChartType,
+		`\chart{c}{a \d 1 \d x}`:                         errInvalidChartData,
+		`\chart{c}{type=pie}{a \d -1}`:                   errInvalidChartData,
+		`\chart{c}{a}`:                                   errInvalidChartData,
+		`\chart{c}{header=1}{a \d b}`:                    errInvalidChartData,
+		`\chart{c}{\span{2} a \tr b \d 1}`:               errInvalidChartData,
+		`\chart{c}{a \d \e{1}}`:                          errExpectPlainText,
+		"\\chart{c}{a \\d 1e308\nb \\d -1e308}":          errInvalidChartData,
+		`\chart{c}{a \d 1.7e308}`:                        errInvalidChartData,
+		"\\chart{c}{type=pie}{a \\d 1e308\nb \\d 1e308}": errInvalidChartData,
+		`\table{t}{type=bar}{a \d 1}`:                    errUnknownTableOption,
+	} {
+		_, err := newDoc(Options{}).ParseChunks(input)
+		if !errors.Is(err, expect) {
+			t.Fatal(input, err)
+		}
+	}
+}
+
+func TestDiagram(t *testing.T) {
+	input := "\\caption{d1}{flow}\n\\diagram{d1}{\n" +
+		"\t+---+    +---+\n" +
+		"\t| a |<-->| b |\n" +
+		"\t+---+    +-+-+\n" +
+		"\t           |\n" +
+		"\t           v\n" +
+		"\t          c&d\n" +
+		"}\n\\diagram-index"
+	grid := newDiagramGrid("\n  +-\n  |\n")
+	if len(grid) != 2 || string(grid[0]) != "+-" || string(grid[1]) != "|" {
+		t.Fatal(grid)
+	}
+	lines, used := newDiagramGrid("+--+\n|  |\n+--+ x\n  <->\n  ^\n  |").diagramLines()
+	if len(lines) != 6 || !lines[2].Arrow1 || !lines[2].Arrow2 || used[[2]int{2, 5}] ||
+		lines[4] != (diagramLine{Row1: 4, Col1: 2, Row2: 5, Col2: 2, Arrow1: true}) {
+		t.Fatal(lines)
+	}
+
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{Language: "en"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		`<a id="d1" class="caption">Diagram 1:  flow</a>`,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="112" height="96" viewBox="0 0 112 96"`,
+		`| a |&lt;--&gt;| b |`,
+		`<text x="16" y="28" xml:space="preserve">a</text>`,
+		`<text x="80" y="92" xml:space="preserve">c&amp;d</text>`,
+		`<p><a href="#d1">Diagram 1:  flow</a></p>`,
+	} {
+		if !strings.Contains(result.Content, expect) {
+			t.Fatal(expect, result.Content)
+		}
+	}
+	//one arrowhead at each end of <-->, one at v
+	if n := strings.Count(result.Content, "<polygon"); n != 3 {
+		t.Fatal(n, result.Content)
+	}
+}
+
+func TestTexToMathML(t *testing.T) {
+	for tex, expect := range map[string]string{
+		`\frac{a}{2}`:      `<mfrac><mi>a</mi><mn>2</mn></mfrac>`,
+		`x_1^{2n}`:         `<msubsup><mi>x</mi><mn>1</mn><mrow><mn>2</mn><mi>n</mi></mrow></msubsup>`,
+		`\alpha+\Omega`:    `<mrow><mi>α</mi><mo>+</mo><mi mathvariant="normal">Ω</mi></mrow>`,
+		`\sum_{i=1}^n`:     `<msubsup><mo>∑</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></msubsup>`,
+		`\int_0^1 f'`:      `<mrow><msubsup><mo>∫</mo><mn>0</mn><mn>1</mn></msubsup><msup><mi>f</mi><mo>′</mo></msup></mrow>`,
+		`\sin x`:           `<mrow><mi>sin</mi><mspace width="0.167em"/><mi>x</mi></mrow>`,
+		`\sqrt[3]{x}`:      `<mroot><mi>x</mi><mn>3</mn></mroot>`,
+		`\left( a \right.`: `<mrow><mo fence="true" stretchy="true">(</mo><mi>a</mi></mrow>`,
+		`\text{if } x<y`:   "<mrow><mtext>if\u00a0</mtext>" + `<mi>x</mi><mo>&lt;</mo><mi>y</mi></mrow>`,
+		`\mathbb{R}`:       `<mi mathvariant="double-struck">R</mi>`,
+		`\begin{bmatrix}1&2\\3&4\end{bmatrix}`: `<mrow><mo fence="true" stretchy="true">[</mo><mtable><mtr><mtd><mn>1</mn></mtd><mtd><mn>2</mn></mtd></mtr>` +
+			`<mtr><mtd><mn>3</mn></mtd><mtd><mn>4</mn></mtd></mtr></mtable><mo fence="true" stretchy="true">]</mo></mrow>`,
+		"a &= b \\\\\n &= c \\\\": `<mtable displaystyle="true" columnalign="right left" columnspacing="0em"><mtr><mtd><mi>a</mi></mtd><mtd><mrow><mo>=</mo><mi>b</mi></mrow></mtd></mtr>` +
+			`<mtr><mtd><mrow></mrow></mtd><mtd><mrow><mo>=</mo><mi>c</mi></mrow></mtd></mtr></mtable>`,
+	} {
+		mathML, errs := texToMathML(tex, false)
+		if len(errs) > 0 || !strings.Contains(mathML, "<semantics>"+expect+"<annotation") {
+			t.Fatal(tex, mathML, errs)
+		}
+	}
+	//the limits go under and over in display math
+	mathML, _ := texToMathML(`\lim_{n\to\infty} x \tag{1}`, true)
+	if !strings.Contains(mathML, `display="block"><semantics><mrow><mrow><munder><mi>lim</mi>`) || !strings.Contains(mathML, `<mtext>(1)</mtext>`) {
+		t.Fatal(mathML)
+	}
+
+	for tex, expect := range map[string]error{
+		`\foo \foo x`:                   errUnsupportedTex,
+		`\begin{tikzcd} a \end{tikzcd}`: errUnsupportedTex,
+		`\frac{a}`:                      errInvalidTex,
+		`{a`:                            errInvalidTex,
+		`a}`:                            errInvalidTex,
+		`\left( a`:                      errInvalidTex,
+		`x^1^2`:                         errInvalidTex,
+		`\begin{matrix} a \end{array}`:  errInvalidTex,
+	} {
+		mathML, errs := texToMathML(tex, false)
+		if len(errs) != 1 || !errors.Is(errs[0], expect) {
+			t.Fatal(tex, errs)
+		}
+		if expect == errUnsupportedTex && !strings.Contains(mathML, "<merror>") {
+			t.Fatal(mathML)
+		}
+	}
+
+	input := "\\t \\r#{x^2}# \\tex{e} \\r#{\\frac{1}{2} \\color{red}}#"
+	result, err := Compile(context.Background(), strings.NewReader(input), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result.Content, `<span class="inline-tex"><math xmlns="http://www.w3.org/1998/Math/MathML"><semantics><msup>`) ||
+		!strings.Contains(result.Content, `<div class="math"><math xmlns="http://www.w3.org/1998/Math/MathML" display="block">`) {
+		t.Fatal(result.Content)
+	}
+	if len(result.Warnings) != 1 || !errors.Is(result.Warnings[0], errUnsupportedTex) || result.Warnings[0].Keyword != BlockTex {
+		t.Fatal(result.Warnings)
+	}
+	_, err = Compile(context.Background(), strings.NewReader(input), Options{Strict: true})
+	if !errors.Is(err, errUnsupportedTex) {
+		t.Fatal(err)
+	}
+	//the tex is left as it is for MathJax
+	result, err = Compile(context.Background(), strings.NewReader(input), Options{MathJax: true})
+	if err != nil || len(result.Warnings) > 0 {
+		t.Fatal(err, result.Warnings)
+	}
+	if !strings.Contains(result.Content, `<span class="inline-tex">\(x^2\)</span>`) || !strings.Contains(result.Content, `\[\frac{1}{2} \color{red}\]`) {
+		t.Fatal(result.Content)
+	}
+	//the shipped template for MathJax loads it
+	tmpl, err := template.ParseFiles("template-mathjax.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = Compile(context.Background(), strings.NewReader(input), Options{MathJax: true, Template: tmpl})
+	if err != nil || !strings.Contains(result.Content, "mathjax@3") || !strings.Contains(result.Content, `\(x^2\)`) {
+		t.Fatal(err, result.Content)
+	}
+}
@@ -0,0 +1,59 @@
+package hairtail
+
+import (
+	"fmt"
+)
+
+// CiteChunk denotes \cite{key} or \cite{key1, key2}
+type CiteChunk struct {
+	Position int
+	Keys     []string
+	Entries  []*BibEntry //set in CiteChunkHandle, one per key, nil if the key is not in the bibliography
+}
+
+// String implements the Stringer interface
+func (p CiteChunk) String() string {
+	return fmt.Sprintf("CiteChunk{Position: %d, Keys: %v }", p.GetPosition(), p.Keys)
+}
+
+// GetPosition implements the Chunk interface
+func (p *CiteChunk) GetPosition() int {
+	return p.Position
+}
+
+// SetPosition implements the Chunk interface
+func (p *CiteChunk) SetPosition(pos int) {
+	p.Position = pos
+}
+
+// GetValue implements the Chunk interface
+func (p *CiteChunk) GetValue() string {
+	return fmt.Sprint(p.Keys)
+}
+
+// BibliographyChunk denotes \bibliography{file}, the entries of the BibTeX file are read while parsing
+type BibliographyChunk struct {
+	Position int
+	File     string
+	Entries  []*BibEntry //in the order of the file
+}
+
+// String implements the Stringer interface
+func (p BibliographyChunk) String() string {
+	return fmt.Sprintf("BibliographyChunk{Position: %d, File: %v, Entries: %d }", p.GetPosition(), p.File, len(p.Entries))
+}
+
+// GetPosition implements the Chunk interface
+func (p *BibliographyChunk) GetPosition() int {
+	return p.Position
+}
+
+// SetPosition implements the Chunk interface
+func (p *BibliographyChunk) SetPosition(pos int) {
+	p.Position = pos
+}
+
+// GetValue implements the Chunk interface
+func (p *BibliographyChunk) GetValue() string {
+	return p.File
+}
@@ -0,0 +1,162 @@
+// Command hairtail compiles a hairtail document to html.
+package main
+
+import (
+	"context"
+	"flag"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/henryscala/hairtail"
+)
+
+//command flags
+var (
+	gInputFile           = flag.String("i", "input.txt", "input file to process")
+	gOutputFile          = flag.String("o", "output.html", "out file to put result")
+	gTemplateFile        = flag.String("t", "template.html", "template file with hole to be filled in")
+	gLanguage            = flag.String("language", "cn", "language of the output (cn|en)")
+	gMaxErrors           = flag.Int("max-errors", 10, "max number of errors to report before giving up, 0 means no limit")
+	gStrict              = flag.Bool("strict", false, "fail on warnings, e.g. references to unknown ids and duplicate ids")
+	gFootnotesPerSection = flag.Bool("footnotes-per-section", false, "number and list the footnotes per top level section, instead of per document")
+	gOutputDir           = flag.String("outdir", "", "directory to put the output files of a build, default is beside the input files")
+	gMathJax             = flag.Bool("mathjax", false, "leave the math as tex for MathJax, instead of converting it to MathML. The template has to load MathJax, e.g. -t template-mathjax.html")
+	gIncludePath         stringList
+)
+
+func init() {
+	log.SetFlags(log.Lshortfile)
+	flag.Var(&gIncludePath, "I", "directory to search for included files, may be repeated")
+}
+
+//stringList is a flag that may be given many times, e.g. -I dir1 -I dir2
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func handleArguments() (hairtail.Options, error) {
+	flag.Parse()
+	opts := hairtail.Options{
+		Language:  *gLanguage,
+		MaxErrors: *gMaxErrors,
+		Strict:    *gStrict,
+
+		FootnotesPerSection: *gFootnotesPerSection,
+		IncludePath:         gIncludePath,
+		MathJax:             *gMathJax,
+	}
+	if *gTemplateFile != "" {
+		tmpl, err := template.ParseFiles(*gTemplateFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.Template = tmpl
+	}
+	return opts, nil
+}
+
+//buildFiles returns the files of a build, i.e. the input files given as arguments, e.g. hairtail -outdir html *.txt
+//With -outdir, the output files keep the paths of the input files relative to the directory they have in common,
+//e.g. a/intro.txt and b/intro.txt are written to html/a/intro.html and html/b/intro.html.
+func buildFiles(inputFiles []string) ([]hairtail.BuildFile, error) {
+	root, err := commonDir(inputFiles)
+	if err != nil {
+		return nil, err
+	}
+	var files []hairtail.BuildFile
+	for _, inputFile := range inputFiles {
+		outputFile := strings.TrimSuffix(inputFile, filepath.Ext(inputFile)) + ".html"
+		if *gOutputDir != "" {
+			abs, err := filepath.Abs(outputFile)
+			if err != nil {
+				return nil, err
+			}
+			rel, err := filepath.Rel(root, abs)
+			if err != nil {
+				return nil, err
+			}
+			outputFile = filepath.Join(*gOutputDir, rel)
+		}
+		files = append(files, hairtail.BuildFile{InputFile: inputFile, OutputFile: outputFile})
+	}
+	return files, nil
+}
+
+//commonDir returns the absolute directory that contains every one of files
+func commonDir(files []string) (string, error) {
+	var root string
+	for i, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return "", err
+		}
+		dir := filepath.Dir(abs)
+		if i == 0 {
+			root = dir
+			continue
+		}
+		for {
+			rel, err := filepath.Rel(root, dir)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				break
+			}
+			if filepath.Dir(root) == root {
+				break //the root of the file system, or another volume on windows
+			}
+			root = filepath.Dir(root)
+		}
+	}
+	return root, nil
+}
+
+//compileFile compiles a single document, it returns the warnings like hairtail.Build
+func compileFile(inputFile, outputFile string, opts hairtail.Options) (hairtail.DiagnosticList, error) {
+	input, err := os.Open(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	opts.FilePath = inputFile
+	result, err := hairtail.Compile(context.Background(), input, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result.Warnings, ioutil.WriteFile(outputFile, []byte(result.Content), 0666)
+}
+
+func main() {
+
+	opts, err := handleArguments()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var warnings hairtail.DiagnosticList
+	if flag.NArg() > 0 {
+		var files []hairtail.BuildFile
+		files, err = buildFiles(flag.Args())
+		if err == nil {
+			warnings, err = hairtail.Build(files, opts)
+		}
+	} else {
+		warnings, err = compileFile(*gInputFile, *gOutputFile, opts)
+	}
+	for _, warning := range warnings {
+		log.Println("warning:", warning)
+	}
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,110 @@
+package hairtail
+
+import (
+	"strings"
+	"unicode"
+)
+
+var gPinyinRank = make(map[rune]int)
+
+// gLatinBase is the base letter of the accented Latin letters as their canonical decomposition, e.g. 'e' of 'é' and 'É'
+var gLatinBase = make(map[rune]rune)
+
+func init() {
+	for i, r := range gPinyinOrder {
+		gPinyinRank[r] = i
+	}
+	for base, letters := range map[rune]string{
+		'a': "ÀÁÂÃÄÅàáâãäåĀāĂăĄąǍǎǞǟǠǡǺǻȀȁȂȃȦȧ",
+		'c': "ÇçĆćĈĉĊċČč",
+		'd': "Ďď",
+		'e': "ÈÉÊËèéêëĒēĔĕĖėĘęĚěȄȅȆȇȨȩ",
+		'g': "ĜĝĞğĠġĢģǦǧǴǵ",
+		'h': "ĤĥȞȟ",
+		'i': "ÌÍÎÏìíîïĨĩĪīĬĭĮįİǏǐȈȉȊȋ",
+		'j': "Ĵĵǰ",
+		'k': "ĶķǨǩ",
+		'l': "ĹĺĻļĽľ",
+		'n': "ÑñŃńŅņŇňǸǹ",
+		'o': "ÒÓÔÕÖòóôõöŌōŎŏŐőƠơǑǒǪǫǬǭȌȍȎȏȪȫȬȭȮȯȰȱ",
+		'r': "ŔŕŖŗŘřȐȑȒȓ",
+		's': "ŚśŜŝŞşŠšȘș",
+		't': "ŢţŤťȚț",
+		'u': "ÙÚÛÜùúûüŨũŪūŬŭŮůŰűŲųƯưǓǔǕǖǗǘǙǚǛǜȔȕȖȗ",
+		'w': "Ŵŵ",
+		'y': "ÝýÿŶŷŸȲȳ",
+		'z': "ŹźŻżŽž",
+	} {
+		for _, r := range letters {
+			gLatinBase[r] = base
+		}
+	}
+}
+
+// latinBase returns the base letter of r if it is an accented Latin letter, otherwise r itself
+func latinBase(r rune) rune {
+	if base, ok := gLatinBase[r]; ok {
+		return base
+	}
+	return r
+}
+
+// termInitial returns the letter a term is grouped under in the index, i.e. the first letter(without accent) of a Latin term,
+// or the initial letter of the pinyin of a Chinese term. It is '#' for terms beginning with digits, symbols, etc.
+func termInitial(term string) rune {
+	for _, r := range term {
+		r = latinBase(r)
+		if r < unicode.MaxASCII && unicode.IsLetter(r) {
+			return unicode.ToUpper(r)
+		}
+		rank, ok := gPinyinRank[r]
+		if !ok {
+			return '#'
+		}
+		letter := '#'
+		for _, initial := range gPinyinInitials {
+			if gPinyinRank[initial.First] > rank {
+				break
+			}
+			letter = initial.Letter
+		}
+		return letter
+	}
+	return '#'
+}
+
+// runeKey orders the runes of terms, Latin letters ignoring case and accent go first, then hanzi in the order of pinyin, then the others
+func runeKey(r rune) (class int, key int) {
+	r = latinBase(r)
+	if r < unicode.MaxASCII && unicode.IsLetter(r) {
+		return 0, int(unicode.ToLower(r))
+	}
+	if rank, ok := gPinyinRank[r]; ok {
+		return 1, rank
+	}
+	return 2, int(r)
+}
+
+// termLess reports whether term1 goes before term2 in the index.
+// Terms are grouped by termInitial, so English and Chinese terms beginning with the same letter are next to each other.
+func termLess(term1, term2 string) bool {
+	initial1, initial2 := termInitial(term1), termInitial(term2)
+	if initial1 != initial2 {
+		return initial1 < initial2 //'#' goes before letters
+	}
+	runes1, runes2 := []rune(term1), []rune(term2)
+	for i := 0; i < len(runes1) && i < len(runes2); i++ {
+		class1, key1 := runeKey(runes1[i])
+		class2, key2 := runeKey(runes2[i])
+		if class1 != class2 {
+			return class1 < class2
+		}
+		if key1 != key2 {
+			return key1 < key2
+		}
+	}
+	if len(runes1) != len(runes2) {
+		return len(runes1) < len(runes2)
+	}
+	return strings.Compare(term1, term2) < 0
+}
@@ -0,0 +1,141 @@
+package hairtail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errIncludeCycle     = errors.New("include cycle")
+	errFileNotFound     = errors.New("not found")
+	errFragmentNotFound = errors.New("no section or anchor with id")
+)
+
+// Result is the outcome of compiling one document, it belongs to the caller
+type Result struct {
+	Doc     *Doc   //meta data and indices of the document
+	Content string //the rendered html, already put in Options.Template if there is one
+	//Warnings is the problems that do not stop compiling, e.g. references to unknown ids.
+	//They are returned as errors instead if Options.Strict is set.
+	Warnings DiagnosticList
+}
+
+// Compile parses the document read from r and renders it to html.
+// Every call compiles with a document of its own, so it is safe to call Compile from many goroutines at the same time.
+func Compile(ctx context.Context, r io.Reader, opts Options) (*Result, error) {
+	inputContent, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	opts, err = checkOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	doc := newDoc(opts)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	chunks, err := doc.ParseChunks(string(inputContent))
+	if err != nil {
+		return nil, doc.fileError(err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return doc.render(chunks)
+}
+
+// fileError tells the diagnostics in err the file of doc, and keeps no more than Options.MaxErrors of them
+func (doc *Doc) fileError(err error) error {
+	setDiagnosticFile(err, doc.FilePath)
+	if diagnostics, ok := err.(DiagnosticList); ok && doc.tooManyErrors(diagnostics) {
+		err = diagnostics[:doc.options.MaxErrors]
+	}
+	return err
+}
+
+// render renders the parsed chunks to html, and puts it in Options.Template if there is one
+func (doc *Doc) render(chunks []Chunk) (*Result, error) {
+	doc.inlineRenderMode = false
+	outputContent, err := doc.ChunkListRender(chunks)
+	if err != nil {
+		return nil, doc.fileError(err)
+	}
+
+	if doc.options.Template != nil {
+		var buf bytes.Buffer
+		err = doc.options.Template.Execute(&buf, template.HTML(outputContent))
+		if err != nil {
+			return nil, err
+		}
+		outputContent = buf.String()
+	}
+
+	setDiagnosticFile(doc.warnings, doc.FilePath)
+	return &Result{Doc: doc, Content: outputContent, Warnings: doc.warnings}, nil
+}
+
+// CompileFile compiles inputFile and writes the result to outputFile.
+// opts.FilePath is set to inputFile.
+func CompileFile(inputFile, outputFile string, opts Options) error {
+	inputContent, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		return err
+	}
+	opts.FilePath = inputFile
+	result, err := Compile(context.Background(), bytes.NewReader(inputContent), opts)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outputFile, []byte(result.Content), 0666)
+}
+
+// fileToChunks parses an included file, the files including it are in doc.includeStack
+func (doc *Doc) fileToChunks(inputFile string) ([]Chunk, error) {
+	chain := append([]string{doc.FilePath}, doc.includeStack...)
+	for i, file := range chain {
+		if sameFile(file, inputFile) {
+			return nil, fmt.Errorf("%w: %s", errIncludeCycle, strings.Join(append(chain[i:], inputFile), " -> "))
+		}
+	}
+
+	inputContent, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	doc.includeStack = append(doc.includeStack, inputFile)
+	defer func() {
+		doc.includeStack = doc.includeStack[:len(doc.includeStack)-1]
+	}()
+	return doc.parseChunks(string(inputContent))
+}
+
+// currentFile returns the file being parsed, which is either an included file or doc.FilePath
+func (doc *Doc) currentFile() string {
+	if len(doc.includeStack) > 0 {
+		return doc.includeStack[len(doc.includeStack)-1]
+	}
+	return doc.FilePath
+}
+
+// sameFile reports whether the two paths refer to the same file
+func sameFile(path1, path2 string) bool {
+	if path1 == "" || path2 == "" {
+		return false
+	}
+	abs1, err1 := filepath.Abs(path1)
+	abs2, err2 := filepath.Abs(path2)
+	if err1 != nil || err2 != nil {
+		return filepath.Clean(path1) == filepath.Clean(path2)
+	}
+	return abs1 == abs2
+}
@@ -1,17 +1,31 @@
-package main
+package hairtail
 
 import (
-	"log"
+	"fmt"
+	"html/template"
 )
 
-type Config struct {
-	Language     string //en,cn
-	TemplateFile string // the template file with hole to put render result in
+// Options controls how a document is compiled
+type Options struct {
+	FilePath  string             //path of the input, included files are relative to it and diagnostics refer to it
+	Language  string             //en,cn
+	Template  *template.Template //optional, the template with hole to put render result in
+	MaxErrors int                //stop after reporting so many errors, 0 means no limit
+	Strict    bool               //fail on the problems reported as Result.Warnings, e.g. references to unknown ids
+	//FootnotesPerSection numbers the footnotes per top level section, and lists them at the end of the section.
+	//Otherwise they are numbered per document, and listed at the end of the document.
+	FootnotesPerSection bool
+	//IncludePath is the directories to search for included files, in order.
+	//They are searched after the directory of the file that contains the include keyword.
+	IncludePath []string
+	//MathJax leaves the formulas of \t and \tex as tex, for MathJax loaded by Options.Template to render them in the browser.
+	//Otherwise they are converted to MathML, which the browsers render without scripts.
+	MathJax bool
 	//GenerateTitle bool   //main title and sub title
 	//GenerateMeta  bool   //create date, modify date, keywords
 }
 
-var gConfig = Config{
+var gDefaultOptions = Options{
 	Language: "cn",
 }
 
@@ -21,12 +35,14 @@ var gLanguageKeywordName = map[string]map[string]string{
 }
 
 var gKeywordNameCn = map[string]string{
-	OrderList:    "有序列表",
-	BulletList:   "无序列表",
-	TableKeyword: "表格",
-	BlockCode:    "代码",
-	BlockTex:     "数学公式",
-	ImageKeyword: "图",
+	OrderList:      "有序列表",
+	BulletList:     "无序列表",
+	TableKeyword:   "表格",
+	BlockCode:      "代码",
+	BlockTex:       "数学公式",
+	ImageKeyword:   "图",
+	ChartKeyword:   "图表",
+	DiagramKeyword: "示意图",
 
 	AuthorKeyword:     "作者",
 	CreateDateKeyword: "创建日期",
@@ -34,12 +50,14 @@ var gKeywordNameCn = map[string]string{
 	KeywordsKeyword:   "关键词",
 }
 var gKeywordNameEn = map[string]string{
-	OrderList:    "Ordered-List",
-	BulletList:   "Bullet-List",
-	TableKeyword: "Table",
-	BlockCode:    "Code",
-	BlockTex:     "Math",
-	ImageKeyword: "Figure",
+	OrderList:      "Ordered-List",
+	BulletList:     "Bullet-List",
+	TableKeyword:   "Table",
+	BlockCode:      "Code",
+	BlockTex:       "Math",
+	ImageKeyword:   "Figure",
+	ChartKeyword:   "Chart",
+	DiagramKeyword: "Diagram",
 
 	AuthorKeyword:     "Author",
 	CreateDateKeyword: "Create-Date",
@@ -47,14 +65,25 @@ var gKeywordNameEn = map[string]string{
 	KeywordsKeyword:   "Keywords",
 }
 
-func getKeywordName(keyword string) string {
-	prefixMap, ok := gLanguageKeywordName[gConfig.Language]
-	if !ok {
-		log.Fatal("not supported language")
+// getKeywordName returns the name of keyword in the language of the document, e.g. "Table" for \table in en.
+// It falls back to the name in the default language, and then to the keyword itself, e.g. for a keyword registered by RegisterKeyword.
+func (doc *Doc) getKeywordName(keyword string) string {
+	if name, ok := gLanguageKeywordName[doc.options.Language][keyword]; ok {
+		return name
 	}
-	prefix, ok := prefixMap[keyword]
-	if !ok {
-		log.Fatal("not supported keyword")
+	if name, ok := gLanguageKeywordName[gDefaultOptions.Language][keyword]; ok {
+		return name
 	}
-	return prefix
+	return keyword
+}
+
+// checkOptions fills in the default value of options not set, and reports options not supported
+func checkOptions(opts Options) (Options, error) {
+	if opts.Language == "" {
+		opts.Language = gDefaultOptions.Language
+	}
+	if _, ok := gLanguageKeywordName[opts.Language]; !ok {
+		return opts, fmt.Errorf("not supported language %q", opts.Language)
+	}
+	return opts, nil
 }
@@ -0,0 +1,217 @@
+package hairtail
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Diagnostic denotes a problem found in the input document.
+// It tells the writer where the problem is, instead of only what the problem is.
+type Diagnostic struct {
+	File     string //the file the problem is found in, empty if the input is not read from a file
+	Position int    //byte offset in the input, the same as Chunk.GetPosition
+	Line     int    //1 based, 0 means not located yet
+	Column   int    //1 based, counted in characters rather than bytes
+	Keyword  string //the keyword being handled when the problem is found, may be empty
+	Excerpt  string //the offending line of the input with a caret under the column
+	Err      error  //the underlying error, e.g. errExpectRBrace
+	//Related is another place of the input involved in the problem, e.g. the first definition of a duplicate id
+	Related *Diagnostic
+}
+
+// Error implements the error interface
+func (d *Diagnostic) Error() string {
+	var buf bytes.Buffer
+	if d.File != "" {
+		buf.WriteString(d.File)
+		buf.WriteString(":")
+	}
+	if d.Line > 0 {
+		fmt.Fprintf(&buf, "%d:%d: ", d.Line, d.Column)
+	} else {
+		fmt.Fprintf(&buf, "position %d: ", d.Position)
+	}
+	if d.Keyword != "" {
+		buf.WriteString(EscapeChar + d.Keyword + ": ")
+	}
+	buf.WriteString(d.Err.Error())
+	if d.Excerpt != "" {
+		buf.WriteString(LineFeed)
+		buf.WriteString(d.Excerpt)
+	}
+	if d.Related != nil {
+		buf.WriteString(LineFeed)
+		buf.WriteString(d.Related.Error())
+	}
+	return buf.String()
+}
+
+// Unwrap makes errors.Is work with the sentinel errors, e.g. errors.Is(err, errExpectRBrace)
+func (d *Diagnostic) Unwrap() error {
+	return d.Err
+}
+
+// newDiagnostic reports err at the position of the keyword token.
+// If err is already a Diagnostic or DiagnosticList, it is returned as is, so that the innermost(most accurate) position is kept.
+func newDiagnostic(token Chunk, err error) error {
+	switch err.(type) {
+	case *Diagnostic, DiagnosticList:
+		return err
+	}
+	keyword := token.GetValue()
+	if keywordChunk, ok := token.(*KeywordChunk); ok {
+		keyword = keywordChunk.Keyword
+	}
+	return &Diagnostic{Position: token.GetPosition(), Keyword: keyword, Err: err}
+}
+
+// locate computes Line, Column and Excerpt from Position, input is the text Position refers to
+func (d *Diagnostic) locate(input string) {
+	if d.Line > 0 {
+		return
+	}
+	pos := d.Position
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > len(input) {
+		pos = len(input)
+	}
+	lineStart := strings.LastIndex(input[:pos], LineFeed) + 1
+	lineEnd := strings.Index(input[pos:], LineFeed)
+	if lineEnd < 0 {
+		lineEnd = len(input)
+	} else {
+		lineEnd += pos
+	}
+	d.Line = strings.Count(input[:lineStart], LineFeed) + 1
+	d.Column = utf8.RuneCountInString(input[lineStart:pos]) + 1
+
+	line := strings.TrimRight(input[lineStart:lineEnd], "\r")
+	//keep tabs in front of the caret, so that the caret is under the right char whatever the tab width is
+	var caret bytes.Buffer
+	for _, r := range input[lineStart:pos] {
+		if r == '\t' {
+			caret.WriteRune(r)
+		} else {
+			caret.WriteString(" ")
+		}
+	}
+	caret.WriteString("^")
+	d.Excerpt = line + LineFeed + caret.String()
+}
+
+// source is the text of the document or of an included file.
+// The positions of a source start at Base, right after the positions of the sources parsed before it,
+// so that the position of a chunk tells which file the chunk comes from.
+type source struct {
+	File    string
+	Content string
+	Base    int
+}
+
+// addSource records the content of file, and returns the base of its positions
+func (doc *Doc) addSource(file, content string) int {
+	base := 0
+	if n := len(doc.sources); n > 0 {
+		last := doc.sources[n-1]
+		base = last.Base + len(last.Content) + 1
+	}
+	doc.sources = append(doc.sources, source{File: file, Content: content, Base: base})
+	return base
+}
+
+// locateDiagnostic locates every Diagnostic inside err in the source its position belongs to.
+// Position is made relative to that source, and File is set to it.
+func (doc *Doc) locateDiagnostic(err error) error {
+	forEachDiagnostic(err, func(diag *Diagnostic) {
+		if diag.Line > 0 || len(doc.sources) == 0 {
+			return
+		}
+		src := doc.sources[0]
+		for _, s := range doc.sources[1:] {
+			if diag.Position >= s.Base {
+				src = s
+			}
+		}
+		diag.Position -= src.Base
+		diag.locate(src.Content)
+		if diag.File == "" {
+			diag.File = src.File
+		}
+	})
+	return err
+}
+
+// DiagnosticList collects the diagnostics found in one run, so that the writer is able to fix all of them at once
+type DiagnosticList []*Diagnostic
+
+// Error implements the error interface, one diagnostic is printed after another
+func (l DiagnosticList) Error() string {
+	var buf bytes.Buffer
+	for i, diag := range l {
+		if i > 0 {
+			buf.WriteString(LineFeed)
+		}
+		buf.WriteString(diag.Error())
+	}
+	return buf.String()
+}
+
+// Unwrap makes errors.Is and errors.As look into every diagnostic in the list
+func (l DiagnosticList) Unwrap() []error {
+	errs := make([]error, len(l))
+	for i, diag := range l {
+		errs[i] = diag
+	}
+	return errs
+}
+
+// add appends err to the list, err may be either a Diagnostic or a DiagnosticList.
+// It returns false if err is some other error, which means the run is not able to go on.
+func (l *DiagnosticList) add(err error) bool {
+	switch e := err.(type) {
+	case nil:
+	case *Diagnostic:
+		*l = append(*l, e)
+	case DiagnosticList:
+		*l = append(*l, e...)
+	default:
+		return false
+	}
+	return true
+}
+
+// err returns the list as an error, or nil if there is nothing in the list
+func (l DiagnosticList) err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// forEachDiagnostic calls f with every Diagnostic inside err, including the related ones
+func forEachDiagnostic(err error, f func(diag *Diagnostic)) {
+	switch e := err.(type) {
+	case *Diagnostic:
+		for ; e != nil; e = e.Related {
+			f(e)
+		}
+	case DiagnosticList:
+		for _, diag := range e {
+			forEachDiagnostic(diag, f)
+		}
+	}
+}
+
+// setDiagnosticFile tells the diagnostics inside err which file they come from.
+// Diagnostics of included files already know it, and are kept as they are.
+func setDiagnosticFile(err error, file string) {
+	forEachDiagnostic(err, func(diag *Diagnostic) {
+		if diag.File == "" {
+			diag.File = file
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package hairtail
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// the size of a char of the art in the svg, in pixels
+const (
+	gDiagramCharWidth  = 8
+	gDiagramCharHeight = 16
+)
+
+// DiagramChunk denotes a diagram drawn in ASCII art, e.g. boxes joined by arrows
+type DiagramChunk struct {
+	Position  int
+	Id        string
+	Caption   string //optional
+	Numbering string //optional Numbering before Caption
+	Value     string //the art as it is written, for the backends not able to draw it
+}
+
+// String implements the Stringer interface
+func (p DiagramChunk) String() string {
+	return fmt.Sprintf("DiagramChunk{Position: %d, Id: %v, Caption: %v, Value: %v}",
+		p.GetPosition(), p.Id, p.Caption, p.Value)
+}
+
+// GetPosition implements the Chunk interface
+func (p *DiagramChunk) GetPosition() int {
+	return p.Position
+}
+
+// SetPosition implements the Chunk interface
+func (p *DiagramChunk) SetPosition(pos int) {
+	p.Position = pos
+}
+
+// GetValue implements the Chunk interface
+func (p *DiagramChunk) GetValue() string {
+	return p.Value
+}
+
+func (p *DiagramChunk) GetId() string {
+	return p.Id
+}
+
+func (p *DiagramChunk) GetCaption() string {
+	return p.Caption
+}
+
+func (p *DiagramChunk) SetCaption(c string) {
+	p.Caption = c
+}
+
+func (p *DiagramChunk) SetNumbering(c string) {
+	p.Numbering = c
+}
+
+func (p DiagramChunk) GetNumbering() string {
+	return p.Numbering
+}
+
+func (doc *Doc) diagramBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
+	if err != nil {
+		return outputChunks, index, err
+	}
+	art, newIndex, err := consumeRawText(inputChunks, newIndex)
+	if err != nil {
+		return outputChunks, index, err
+	}
+	diagramChunk := &DiagramChunk{
+		Position: token.GetPosition(),
+		Id:       tokenChunks[1].GetValue(),
+		Value:    art,
+	}
+	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
+		Keyword:  token.GetValue(),
+		Children: []Chunk{diagramChunk},
+	}
+	outputChunks = append(outputChunks, keywordChunk)
+	return outputChunks, newIndex, nil
+}
+
+// diagramGrid is the chars of the art by row and column.
+// A wide char, e.g. a Chinese one, takes two columns as it does in a text editor, the second one is 0.
+type diagramGrid [][]rune
+
+// newDiagramGrid lays out art in a grid, the tabs are expanded to 8 columns,
+// the blank lines around the art and the blanks in front of every line are removed
+func newDiagramGrid(art string) diagramGrid {
+	lines := strings.Split(strings.Replace(art, "\r\n", LineFeed, -1), LineFeed)
+	var grid diagramGrid
+	for _, line := range lines {
+		var row []rune
+		for _, r := range line {
+			switch {
+			case r == '\t':
+				row = append(row, ' ')
+				for len(row)%8 != 0 {
+					row = append(row, ' ')
+				}
+			case r >= 0x1100:
+				row = append(row, r, 0)
+			default:
+				row = append(row, r)
+			}
+		}
+		for len(row) > 0 && row[len(row)-1] == ' ' {
+			row = row[:len(row)-1]
+		}
+		grid = append(grid, row)
+	}
+	for len(grid) > 0 && len(grid[0]) == 0 {
+		grid = grid[1:]
+	}
+	for len(grid) > 0 && len(grid[len(grid)-1]) == 0 {
+		grid = grid[:len(grid)-1]
+	}
+
+	indent := -1
+	for _, row := range grid {
+		n := 0
+		for n < len(row) && row[n] == ' ' {
+			n++
+		}
+		if len(row) > 0 && (indent < 0 || n < indent) {
+			indent = n
+		}
+	}
+	for i, row := range grid {
+		if len(row) > 0 && indent > 0 {
+			grid[i] = row[indent:]
+		}
+	}
+	return grid
+}
+
+// at returns the char at row and col, or a blank if it is out of the art
+func (g diagramGrid) at(row, col int) rune {
+	if row < 0 || row >= len(g) || col < 0 || col >= len(g[row]) {
+		return ' '
+	}
+	return g[row][col]
+}
+
+// width returns the number of columns of the widest row
+func (g diagramGrid) width() int {
+	width := 0
+	for _, row := range g {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+	return width
+}
+
+// diagramLine is a horizontal or vertical line of the art, from the cell (Row1, Col1) to (Row2, Col2) inclusive
+type diagramLine struct {
+	Row1, Col1, Row2, Col2 int
+	Arrow1, Arrow2         bool //an arrowhead at the start or the end
+}
+
+// diagramLines finds the lines in g, used is set to the cells taken by the lines, the other cells are text.
+// A horizontal line is made of - and +, at least one -, starting with < or ending with > if it has an arrowhead, e.g. <-->.
+// A vertical line is made of | and +, at least one |, starting with ^ or ending with v if it has an arrowhead.
+// + is a corner where the lines join.
+func (g diagramGrid) diagramLines() (lines []diagramLine, used map[[2]int]bool) {
+	used = make(map[[2]int]bool)
+	//runs finds the lines along one direction, at(i, j) is the j-th char of the i-th row or column
+	runs := func(count, length int, at func(i, j int) rune, head, body, tail, must rune, line func(i, j1, j2 int, arrow1, arrow2 bool)) {
+		for i := 0; i < count; i++ {
+			for j := 0; j < length; {
+				start, hasMust := j, false
+				arrow1 := at(i, j) == head
+				if arrow1 {
+					j++
+				}
+				for at(i, j) == body || at(i, j) == '+' {
+					hasMust = hasMust || at(i, j) == must
+					j++
+				}
+				arrow2 := j > start && !(arrow1 && j == start+1) && at(i, j) == tail
+				if arrow2 {
+					j++
+				}
+				if !hasMust || j-start < 2 && body == '-' {
+					j = start + 1
+					continue
+				}
+				line(i, start, j-1, arrow1, arrow2)
+			}
+		}
+	}
+
+	width := g.width()
+	runs(len(g), width, g.at, '<', '-', '>', '-', func(row, col1, col2 int, arrow1, arrow2 bool) {
+		lines = append(lines, diagramLine{Row1: row, Col1: col1, Row2: row, Col2: col2, Arrow1: arrow1, Arrow2: arrow2})
+		for col := col1; col <= col2; col++ {
+			used[[2]int{row, col}] = true
+		}
+	})
+	runs(width, len(g), func(col, row int) rune { return g.at(row, col) }, '^', '|', 'v', '|', func(col, row1, row2 int, arrow1, arrow2 bool) {
+		lines = append(lines, diagramLine{Row1: row1, Col1: col, Row2: row2, Col2: col, Arrow1: arrow1, Arrow2: arrow2})
+		for row := row1; row <= row2; row++ {
+			used[[2]int{row, col}] = true
+		}
+	})
+	return lines, used
+}
+
+// SVG draws the diagram as a self-contained svg element, the art is kept in desc
+func (p *DiagramChunk) SVG() string {
+	grid := newDiagramGrid(p.Value)
+	lines, used := grid.diagramLines()
+	const cw, ch = gDiagramCharWidth, gDiagramCharHeight
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="monospace" font-size="13">`+"\n",
+		grid.width()*cw, len(grid)*ch, grid.width()*cw, len(grid)*ch)
+	fmt.Fprintf(&buf, "<desc>%s</desc>\n", html.EscapeString(p.Value))
+
+	//a line reaches the edge of its end cells, or the center if the end is a corner, so that the lines join at corners
+	buf.WriteString(`<g stroke="#333" stroke-width="1.5" fill="#333">` + "\n")
+	for _, line := range lines {
+		x1, y1 := float64(line.Col1*cw)+cw/2, float64(line.Row1*ch)+ch/2
+		x2, y2 := float64(line.Col2*cw)+cw/2, float64(line.Row2*ch)+ch/2
+		dx, dy := 0.0, 0.0 //from the center to the edge of a cell, along the line
+		if line.Col1 != line.Col2 {
+			//horizontal, a vertical line may be one char long
+			dx = cw / 2
+		} else {
+			dy = ch / 2
+		}
+		if grid.at(line.Row1, line.Col1) != '+' {
+			x1, y1 = x1-dx, y1-dy
+		}
+		if grid.at(line.Row2, line.Col2) != '+' {
+			x2, y2 = x2+dx, y2+dy
+		}
+		fmt.Fprintf(&buf, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/>`+"\n", x1, y1, x2, y2)
+		if line.Arrow1 {
+			writeArrowhead(&buf, x1, y1, -dx, -dy)
+		}
+		if line.Arrow2 {
+			writeArrowhead(&buf, x2, y2, dx, dy)
+		}
+	}
+	buf.WriteString("</g>\n")
+
+	//the chars not taken by lines are text, the words separated by one blank are kept together
+	for row := range grid {
+		for col := 0; col < len(grid[row]); {
+			if grid.at(row, col) == ' ' || used[[2]int{row, col}] {
+				col++
+				continue
+			}
+			start := col
+			var text []rune
+			for col < len(grid[row]) && !used[[2]int{row, col}] &&
+				(grid.at(row, col) != ' ' || grid.at(row, col+1) != ' ' && !used[[2]int{row, col + 1}] && col+1 < len(grid[row])) {
+				if r := grid.at(row, col); r != 0 {
+					text = append(text, r)
+				}
+				col++
+			}
+			fmt.Fprintf(&buf, `<text x="%d" y="%d" xml:space="preserve">%s</text>`+"\n", start*cw, row*ch+ch*3/4, html.EscapeString(string(text)))
+		}
+	}
+	buf.WriteString("</svg>")
+	return buf.String()
+}
+
+// writeArrowhead draws an arrowhead at (x, y) pointing along (dx, dy)
+func writeArrowhead(buf *bytes.Buffer, x, y, dx, dy float64) {
+	const length, half = 8.0, 4.0
+	//the unit vector along the arrow, and the one across it
+	ux, uy := 0.0, 0.0
+	switch {
+	case dx > 0:
+		ux = 1
+	case dx < 0:
+		ux = -1
+	case dy > 0:
+		uy = 1
+	default:
+		uy = -1
+	}
+	fmt.Fprintf(buf, `<polygon points="%.1f,%.1f %.1f,%.1f %.1f,%.1f" stroke="none"/>`+"\n",
+		x, y, x-ux*length-uy*half, y-uy*length+ux*half, x-ux*length+uy*half, y-uy*length-ux*half)
+}
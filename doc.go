@@ -1,5 +1,11 @@
-package main
+// Package hairtail is a simple document preparation system mimicking halibut.
+// It compiles documents written in the hairtail grammar(see Hairtail.g4) to html.
+//
+// Use Compile to compile a document read from an io.Reader, or CompileFile to compile a file.
+// Command hairtail in cmd/hairtail is the command line tool built on top of them.
+package hairtail
 
+// Doc holds the meta data and indices of a document, they are collected while compiling
 type Doc struct {
 	FilePath, //the file path of the document to be compiled
 
@@ -15,13 +21,45 @@ type Doc struct {
 	SectionIndex,
 	ImageIndex,
 	TableIndex,
+	ChartIndex,
+	DiagramIndex,
 	OrderListIndex,
 	BulletListIndex,
 	CodeIndex,
-	MathIndex string
+	MathIndex,
+	TermIndex string //back-of-book index
 
 	//Chunks                                            []Chunk
+
+	options          Options              //how the document is compiled
+	inlineRenderMode bool                 //render plain text as it is, without <p> around it
+	macros           map[string]*macro    //defined by \def, included documents share them
+	includeStack     []string             //the included files being parsed, the innermost is at the end
+	sources          []source             //the text of the document and of the included files, diagnostics are located in them
+	ids              map[string]*Symbol   //the sections, anchors and blocks with id in the document, by id
+	warnings         DiagnosticList       //problems that do not stop compiling, see Options.Strict
+	symbols          *SymbolTable         //the symbols of every document in a build, nil if the document is compiled alone
+	footnotes        []footnoteGroup      //numbered by FootnoteChunkHandle, listed by FootnoteListHandle
+	bibEntries       map[string]*BibEntry //read by \bibliography, by key, the first one is kept if a key is in more than one file
+	outputFile       string               //where the document is written in a build, links to other documents are relative to it
+}
+
+// newDoc returns an empty document to be compiled with opts
+func newDoc(opts Options) *Doc {
+	return &Doc{FilePath: opts.FilePath, options: opts, macros: make(map[string]*macro), bibEntries: make(map[string]*BibEntry)}
 }
 
-//to store meta data of a document
-var gDoc Doc
+// warn keeps the problem in err as a warning, so that compiling goes on.
+// In strict mode, it returns err to fail compiling instead.
+func (doc *Doc) warn(err error) error {
+	if doc.options.Strict {
+		return err
+	}
+	doc.warnings.add(err)
+	return nil
+}
+
+// tooManyErrors reports whether l reaches the max number of errors to be reported in one run
+func (doc *Doc) tooManyErrors(l DiagnosticList) bool {
+	return doc.options.MaxErrors > 0 && len(l) >= doc.options.MaxErrors
+}
@@ -0,0 +1,34 @@
+package hairtail
+
+import (
+	"fmt"
+)
+
+// FootnoteChunk denotes \f{content}, a footnote
+type FootnoteChunk struct {
+	Position int
+	Id       string  //set in FootnoteChunkHandle, unique in the document
+	Number   int     //set in FootnoteChunkHandle, counted per document or per top level section
+	Content  []Chunk //the content may contain other inline keywords
+}
+
+// String implements the Stringer interface
+func (p FootnoteChunk) String() string {
+	return fmt.Sprintf("FootnoteChunk{Position: %d, Id: %v, Number: %d, Content: %v }",
+		p.GetPosition(), p.Id, p.Number, p.Content)
+}
+
+// GetPosition implements the Chunk interface
+func (p *FootnoteChunk) GetPosition() int {
+	return p.Position
+}
+
+// SetPosition implements the Chunk interface
+func (p *FootnoteChunk) SetPosition(pos int) {
+	p.Position = pos
+}
+
+// GetValue implements the Chunk interface
+func (p *FootnoteChunk) GetValue() string {
+	return p.Id
+}
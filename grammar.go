@@ -1,4 +1,4 @@
-package main
+package hairtail
 
 import (
 	"regexp"
@@ -32,6 +32,9 @@ const (
 	CaptionKeyword = "caption"
 	InlineTex      = "t"
 	CommentKeyword = "--" //it is able to comment out other grammar elements
+	IndexTerm      = "i"  //a term of the back-of-book index
+	Footnote       = "f"
+	CiteKeyword    = "cite" //to cite an entry of the bibliography
 
 	//section
 	SectionHeader  = "h"
@@ -43,14 +46,18 @@ const (
 	SectionHeader6 = "h6"
 
 	//Sections that may have caption and may be shown in specific index
-	BlockTex     = "tex"
-	BlockCode    = "code"
-	OrderList    = "ol"
-	BulletList   = "ul"
-	ListItemMark = "-"
-	TableKeyword = "table"
+	BlockTex       = "tex"
+	BlockCode      = "code"
+	DiagramKeyword = "diagram" //ASCII art drawn as svg
+	OrderList      = "ol"
+	BulletList     = "ul"
+	ListItemMark   = "-"
+	TableKeyword   = "table"
 	//sub element of Table
 	TableCellDelimiterKeyword = "d"
+	TableRowDelimiterKeyword  = "tr"    //ends a row, it is the only way to end a row if the table has option rows=explicit
+	TableSpanKeyword          = "span"  //\span{cols} or \span{cols}{rows} makes the cell span more columns or rows
+	ChartKeyword              = "chart" //a chart drawn from the rows of a table
 
 	//meta
 	TitleKeyword      = "title"
@@ -63,14 +70,21 @@ const (
 	//
 	IncludeKeyword string = "include" //to include other document
 
+	//
+	DefKeyword string = "def" //to define macro
+
 	//index
 	SectionIndexKeyword    = "toc"
 	ImageIndexKeyword      = "image-index"
 	TableIndexKeyword      = "table-index"
+	ChartIndexKeyword      = "chart-index"
+	DiagramIndexKeyword    = "diagram-index"
 	OrderListIndexKeyword  = "order-list-index"
 	BulletListIndexKeyword = "bullet-list-index"
 	CodeIndexKeyword       = "code-index"
 	MathIndexKeyword       = "math-index"
+	TermIndexKeyword       = "index"        //back-of-book index of the terms marked by \i
+	BibliographyKeyword    = "bibliography" //reference list of the entries of a BibTeX file cited by \cite
 )
 
 var (
@@ -85,11 +99,11 @@ var (
 	MetaCharMap       = make(map[string]bool)
 	gInlineFormatMap  = make(map[string]bool)
 	gInlineFormatList = []string{
-		EmphasisFormat, StrongFormat, HyperLink, InlineCode, CommentKeyword, AnchorBlock, ReferToBlock, InlineTex,
+		EmphasisFormat, StrongFormat, HyperLink, InlineCode, CommentKeyword, AnchorBlock, ReferToBlock, InlineTex, IndexTerm, Footnote, CiteKeyword,
 	}
 
 	gChunkWithCaptionList = []string{
-		OrderList, BulletList, TableKeyword, BlockCode, ImageKeyword, BlockTex,
+		OrderList, BulletList, TableKeyword, BlockCode, ImageKeyword, BlockTex, ChartKeyword, DiagramKeyword,
 	}
 	gChunkWithCaptionMap = make(map[string]bool)
 
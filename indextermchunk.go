@@ -0,0 +1,35 @@
+package hairtail
+
+import (
+	"fmt"
+)
+
+// IndexTermChunk denotes \i{term} or \i{term}{subterm}, an entry of the back-of-book index
+type IndexTermChunk struct {
+	Position  int
+	Id        string //set in IndexTermChunkHandle, the index links to it
+	Term      string
+	SubTerm   string //optional
+	Numbering string //the numbering of the section the term is in, it is the text of the link in the index
+}
+
+// String implements the Stringer interface
+func (p IndexTermChunk) String() string {
+	return fmt.Sprintf("IndexTermChunk{Position: %d, Id: %v, Term: %v, SubTerm: %v, Numbering: %v }",
+		p.GetPosition(), p.Id, p.Term, p.SubTerm, p.Numbering)
+}
+
+// GetPosition implements the Chunk interface
+func (p *IndexTermChunk) GetPosition() int {
+	return p.Position
+}
+
+// SetPosition implements the Chunk interface
+func (p *IndexTermChunk) SetPosition(pos int) {
+	p.Position = pos
+}
+
+// GetValue implements the Chunk interface
+func (p *IndexTermChunk) GetValue() string {
+	return p.Term
+}
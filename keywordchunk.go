@@ -1,10 +1,10 @@
-package main
+package hairtail
 
 import (
 	"errors"
 	"fmt"
-	"log"
-	"runtime/debug"
+	"io/ioutil"
+	"strconv"
 	"strings"
 )
 
@@ -17,6 +17,7 @@ var (
 	errExpectRawText     = errors.New("expect Raw Text")
 	errExpectListItem    = errors.New("expect List Item ")
 	errExpectChunkWithId = errors.New("expect chunk with specific Id ")
+	errUnexpectedBlank   = errors.New("unexpected blank line between keyword and its block")
 	errNotImplemented    = errors.New("not implemented")
 )
 
@@ -27,11 +28,12 @@ type KeywordChunk struct {
 	Keyword  string
 	Value    string
 	Children []Chunk
+	Args     [][]Chunk //arguments of the keywords registered without KeywordHandler.Parse, one chunk list per argument
 }
 
 // String implements the Stringer interface
 func (p KeywordChunk) String() string {
-	return fmt.Sprintf("keywordChunk{Position:%v,Keyword:%v,Value:%v,Children:%v}", p.Position, p.Keyword, p.Value, p.Children)
+	return fmt.Sprintf("keywordChunk{Position:%v,Keyword:%v,Value:%v,Children:%v,Args:%v}", p.Position, p.Keyword, p.Value, p.Children, p.Args)
 }
 
 // GetPosition implements the Chunk interface
@@ -50,10 +52,11 @@ func (p *KeywordChunk) GetValue() string {
 }
 
 // KeywordChunkHandle parse the inputChunks(which contains MetaCharChunk, PlaintextChunk, RawTextChunk )
-func KeywordChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+func (doc *Doc) KeywordChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
 	var (
 		outputChunks []Chunk
 		index        int
+		diagnostics  DiagnosticList
 	)
 
 	for index < len(inputChunks) {
@@ -68,51 +71,27 @@ func KeywordChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
 
 			token, newIndex, err := consumeToken(inputChunks, index+1)
 			if err != nil {
-				log.Println(err)
-				return nil, err
+				diagnostics.add(&Diagnostic{Position: metaCharChunk.GetPosition(), Err: err})
+				if doc.tooManyErrors(diagnostics) {
+					return outputChunks, diagnostics
+				}
+				index = skipToRecoveryPoint(inputChunks, index+1)
+				continue
 			}
 
-			switch token[0].GetValue() {
-			case EmphasisFormat, StrongFormat:
-				outputChunks, index, err = inlineBlockOneParamHandle(token[0], inputChunks, outputChunks, newIndex)
-
-			case HyperLink:
-				outputChunks, index, err = hyperLinkBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case ImageKeyword:
-				outputChunks, index, err = imageBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case InlineTex:
-				outputChunks, index, err = inlineTexBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case CommentKeyword:
-				outputChunks, index, err = inlineCodeBlockHandle(token[0], inputChunks, outputChunks, newIndex) //note it reuses the inlineCodeBlockHandle
-			case InlineCode:
-				outputChunks, index, err = inlineCodeBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case TableCellDelimiterKeyword, ListItemMark, SectionIndexKeyword, ImageIndexKeyword, TableIndexKeyword, OrderListIndexKeyword, BulletListIndexKeyword, MathIndexKeyword, CodeIndexKeyword:
-				outputChunks, index, err = simpleKeywordHandle(token[0], inputChunks, outputChunks, newIndex)
-			case AnchorBlock:
-				outputChunks, index, err = anchorBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case ReferToBlock:
-				outputChunks, index, err = referToBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case TitleKeyword, SubTitleKeyword, AuthorKeyword, CreateDateKeyword, ModifyDateKeyword, KeywordsKeyword, IncludeKeyword:
-				outputChunks, index, err = metaKeywordHandle(token[0], inputChunks, outputChunks, newIndex)
-			case BlockCode:
-				outputChunks, index, err = blockCodeBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case BlockTex:
-				outputChunks, index, err = blockTexBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case SectionHeader, SectionHeader1, SectionHeader2, SectionHeader3,
-				SectionHeader4, SectionHeader5, SectionHeader6:
-				outputChunks, index, err = sectionBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case OrderList, BulletList:
-				outputChunks, index, err = listBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case TableKeyword:
-				outputChunks, index, err = tableBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			case CaptionKeyword:
-				outputChunks, index, err = captionBlockHandle(token[0], inputChunks, outputChunks, newIndex)
-			default:
-				log.Fatal(errNotImplemented)
+			if handler := lookupKeyword(token[0].GetValue()); handler == nil {
+				err = errNotImplemented
+			} else if handler.Parse != nil {
+				outputChunks, index, err = handler.Parse(doc, token[0], inputChunks, outputChunks, newIndex)
+			} else {
+				outputChunks, index, err = doc.parseKeywordArgs(handler, token[0], inputChunks, outputChunks, newIndex)
 			}
 			if err != nil {
-				log.Fatalln(err)
-				return nil, err
+				//record the error, skip the ill-formed keyword and go on, so that more errors are found in one run
+				if !diagnostics.add(newDiagnostic(token[0], err)) || doc.tooManyErrors(diagnostics) {
+					return outputChunks, diagnostics
+				}
+				index = skipToRecoveryPoint(inputChunks, newIndex)
 			}
 			continue
 		} else {
@@ -121,21 +100,102 @@ func KeywordChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
 		index++
 	}
 
-	return outputChunks, nil
+	return outputChunks, diagnostics.err()
 }
 
-func referToBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
-	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
+// skipToRecoveryPoint returns the index to go on parsing after a keyword failed to be handled.
+// It skips the brace blocks following the keyword if they are balanced, otherwise it skips to the next blank line.
+func skipToRecoveryPoint(inputChunks []Chunk, index int) int {
+	depth := 0
+	for i := index; i < len(inputChunks); i++ {
+		switch chunk := inputChunks[i].(type) {
+		case *MetaCharChunk:
+			if chunk.GetValue() == LeftBraceChar {
+				depth++
+			} else if chunk.GetValue() == RightBraceChar {
+				if depth == 0 {
+					return i //the right brace belongs to the enclosing block
+				}
+				depth--
+				if depth == 0 {
+					next := ignoreBlank(inputChunks, i+1)
+					if next < len(inputChunks) && isMetaChar(inputChunks[next], LeftBraceChar) {
+						i = next - 1 //another block of the same keyword follows
+						continue
+					}
+					return i + 1
+				}
+			}
+		case *PlainTextChunk:
+			if depth == 0 {
+				if next, ok := skipToParagraph(inputChunks, i); ok {
+					return next
+				}
+			}
+		}
+	}
+	if depth == 0 {
+		return len(inputChunks)
+	}
+	//the braces are not balanced, the next blank line is the only place to go on
+	for i := index; i < len(inputChunks); i++ {
+		if next, ok := skipToParagraph(inputChunks, i); ok {
+			return next
+		}
+	}
+	return len(inputChunks)
+}
+
+func isMetaChar(chunk Chunk, metaChar string) bool {
+	metaCharChunk, ok := chunk.(*MetaCharChunk)
+	return ok && metaCharChunk.GetValue() == metaChar
+}
+
+// skipToParagraph checks whether inputChunks[index] contains a blank line.
+// If it does, the text after the blank line is kept in place of the chunk and index is returned.
+func skipToParagraph(inputChunks []Chunk, index int) (int, bool) {
+	plainTextChunk, ok := inputChunks[index].(*PlainTextChunk)
+	if !ok {
+		return index, false
+	}
+	loc := gParagraphDivider.FindStringIndex(plainTextChunk.Value)
+	if loc == nil {
+		return index, false
+	}
+	inputChunks[index] = &PlainTextChunk{
+		Position: plainTextChunk.Position + loc[1],
+		Value:    plainTextChunk.Value[loc[1]:],
+	}
+	return index, true
+}
 
+//referToBlockHandle handles \k{id}, and \k{file#id} that refers to another document of a build.
+//Either may be followed by {text} to be shown instead of the numbering and caption of what it refers to.
+func (doc *Doc) referToBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	var file string
+	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
+	if err != nil {
+		file, tokenChunks, newIndex, err = consumeFileAndId(inputChunks, index)
+	}
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 
+	var value string
+	if followedByBlock(inputChunks, newIndex) {
+		//the text is shown as it is, a keyword in it is reported rather than dropped with the text following it
+		value, newIndex, err = consumeEmbracedText(inputChunks, newIndex)
+		if err != nil {
+			return outputChunks, index, err
+		}
+	}
+
 	chunk := &ReferToChunk{
 		Position: token.GetPosition(),
+		File:     file,
 		Id:       tokenChunks[1].GetValue(),
-		Value:    "",
+		Href:     "#" + tokenChunks[1].GetValue(), //it is resolved again in ReferToChunkHandle
+		Value:    value,                           //it is set to the text of what it refers to in ReferToChunkHandle, if it is empty
 	}
 	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
 		Keyword:  token.GetValue(),
@@ -147,27 +207,23 @@ func referToBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index in
 	return outputChunks, newIndex, nil
 }
 
-func anchorBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) anchorBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
 
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 	chunksContent, newIndex, err := consumeEmbracedBlock(inputChunks, newIndex)
 	if err != nil {
-		log.Fatal(err)
 		return outputChunks, index, err
 	}
 
-	chunksContent, err = KeywordChunkHandle(chunksContent) //recursive
+	chunksContent, err = doc.KeywordChunkHandle(chunksContent) //recursive
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 
 	if len(chunksContent) < 2 {
-		log.Fatalln(errExpectRBrace)
 		return outputChunks, index, errExpectRBrace
 	}
 
@@ -194,15 +250,13 @@ func anchorBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int
 }
 
 //inlineBlockOneParamHandle handles inline format keyword followed by one pair of brace
-func inlineBlockOneParamHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) inlineBlockOneParamHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	chunks, newIndex, err := consumeEmbracedBlock(inputChunks, index)
 	if err != nil {
-		log.Println(err)
 		return outputChunks, index, err
 	}
-	chunks, err = KeywordChunkHandle(chunks) //recursive
+	chunks, err = doc.KeywordChunkHandle(chunks) //recursive
 	if err != nil {
-		log.Println(err)
 		return outputChunks, index, err
 	}
 	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
@@ -214,26 +268,22 @@ func inlineBlockOneParamHandle(token Chunk, inputChunks, outputChunks []Chunk, i
 	return outputChunks, newIndex, nil
 }
 
-func hyperLinkBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) hyperLinkBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	chunksUrl, newIndex, err := consumeEmbracedBlock(inputChunks, index)
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
-	chunksUrl, err = KeywordChunkHandle(chunksUrl) //recursive
+	chunksUrl, err = doc.KeywordChunkHandle(chunksUrl) //recursive
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 
 	chunksContent, newIndex, err := consumeEmbracedBlock(inputChunks, newIndex)
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
-	chunksContent, err = KeywordChunkHandle(chunksContent) //recursive
+	chunksContent, err = doc.KeywordChunkHandle(chunksContent) //recursive
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 
@@ -245,21 +295,18 @@ func hyperLinkBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index
 	return outputChunks, newIndex, nil
 }
 
-func captionBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) captionBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 
 	chunksContent, newIndex, err := consumeEmbracedBlock(inputChunks, newIndex)
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
-	chunksContent, err = KeywordChunkHandle(chunksContent) //recursive
+	chunksContent, err = doc.KeywordChunkHandle(chunksContent) //recursive
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 
@@ -271,17 +318,15 @@ func captionBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index in
 	return outputChunks, newIndex, nil
 }
 
-func imageBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) imageBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
 
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 	chunksContent, newIndex, err := consumeEmbracedBlock(inputChunks, newIndex)
 
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 
@@ -298,22 +343,28 @@ func imageBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int)
 	return outputChunks, newIndex, nil
 }
 
-func inlineTexBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) inlineTexBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 
 	//InlineTex content must be RawTextBlock
+	index, err = ignoreSeparator(inputChunks, index)
+	if err != nil {
+		return outputChunks, index, err
+	}
 	if index >= len(inputChunks) {
-		log.Fatalln(errIndexOutOfBound)
 		return outputChunks, index, errIndexOutOfBound
 	}
 	rawTextChunk, ok := inputChunks[index].(*RawTextChunk)
 	if !ok {
-		log.Fatalln(errExpectRawText)
 		return outputChunks, index, errExpectRawText
 	}
 
+	inlineTexChunk := &InlineTexChunk{
+		Position: rawTextChunk.GetPosition(),
+		Value:    rawTextChunk.GetValue(),
+	}
 	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
 		Keyword:  token.GetValue(),
-		Children: []Chunk{rawTextChunk},
+		Children: []Chunk{inlineTexChunk},
 	}
 
 	outputChunks = append(outputChunks, keywordChunk)
@@ -322,7 +373,7 @@ func inlineTexBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index
 	return outputChunks, newIndex, nil
 }
 
-func inlineCodeBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) inlineCodeBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	chunks, newIndex1, err := consumeEmbracedBlock(inputChunks, index)
 	if err == nil {
 
@@ -333,16 +384,19 @@ func inlineCodeBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index
 		outputChunks = append(outputChunks, keywordChunk)
 		newIndex = newIndex1
 
+	} else if err == errUnexpectedBlank {
+		return outputChunks, index, err
 	} else {
-		index = ignoreBlank(inputChunks, index)
+		index, err = ignoreSeparator(inputChunks, index)
+		if err != nil {
+			return outputChunks, index, err
+		}
 		//InlineCode content may be either EmbracedBlock or RawTextBlock
 		if index >= len(inputChunks) {
-			log.Fatalln(errIndexOutOfBound)
 			return outputChunks, index, errIndexOutOfBound
 		}
 		rawTextChunk, ok := inputChunks[index].(*RawTextChunk)
 		if !ok {
-			log.Fatalln(errExpectRawText)
 			return outputChunks, index, errExpectRawText
 		}
 
@@ -358,11 +412,10 @@ func inlineCodeBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index
 	return outputChunks, newIndex, nil
 }
 
-func blockCodeBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) blockCodeBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
 
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 	chunksContent, newIndex1, err := consumeEmbracedBlock(inputChunks, newIndex)
@@ -379,16 +432,19 @@ func blockCodeBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index
 
 		outputChunks = append(outputChunks, keywordChunk)
 		newIndex = newIndex1
+	} else if err == errUnexpectedBlank {
+		return outputChunks, index, err
 	} else {
-		newIndex = ignoreBlank(inputChunks, newIndex)
+		newIndex, err = ignoreSeparator(inputChunks, newIndex)
+		if err != nil {
+			return outputChunks, index, err
+		}
 		//BlockCode content may be either EmbracedBlock or RawTextBlock
 		if newIndex >= len(inputChunks) {
-			log.Fatalln(errIndexOutOfBound)
 			return outputChunks, index, errIndexOutOfBound
 		}
 		rawTextChunk, ok := inputChunks[newIndex].(*RawTextChunk)
 		if !ok {
-			log.Fatalln(errExpectRawText)
 			return outputChunks, index, errExpectRawText
 		}
 
@@ -409,25 +465,25 @@ func blockCodeBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index
 	return outputChunks, newIndex, nil
 }
 
-func blockTexBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) blockTexBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
 
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 
-	newIndex = ignoreBlank(inputChunks, newIndex)
+	newIndex, err = ignoreSeparator(inputChunks, newIndex)
+	if err != nil {
+		return outputChunks, index, err
+	}
 
-	//BlockCode content must be RawTextBlock
+	//BlockTex content must be RawTextBlock
 	if newIndex >= len(inputChunks) {
-		log.Fatalln(errIndexOutOfBound)
 		return outputChunks, index, errIndexOutOfBound
 	}
 	rawTextChunk, ok := inputChunks[newIndex].(*RawTextChunk)
 
 	if !ok {
-		log.Fatalln(errExpectRawText)
 		return outputChunks, index, errExpectRawText
 	}
 
@@ -447,17 +503,18 @@ func blockTexBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index i
 	return outputChunks, newIndex, nil
 }
 
-func metaKeywordHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) metaKeywordHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	if index >= len(inputChunks) {
+		return outputChunks, index, errIndexOutOfBound
+	}
 
 	plainTextChunk, ok := inputChunks[index].(*PlainTextChunk)
 
 	if !ok {
-		log.Fatalln(errExpectPlainText)
 		return outputChunks, index, errExpectPlainText
 	}
 	firstLineChunk, restLineChunk, err := plainTextChunk.FirstLineRestLines()
 	if err != nil {
-		log.Fatalln(errExpectPlainText)
 		return outputChunks, index, errExpectPlainText
 	}
 	//update the plainTextChunk in-place
@@ -473,7 +530,7 @@ func metaKeywordHandle(token Chunk, inputChunks, outputChunks []Chunk, index int
 		Value:   firstLineChunk.GetValue(),
 	}
 
-	//set meta info to the global doc
+	//set meta info to the doc
 	func(theDoc *Doc, metaKeyword *KeywordChunk) {
 		switch metaKeyword.Keyword {
 		case TitleKeyword:
@@ -493,7 +550,7 @@ func metaKeywordHandle(token Chunk, inputChunks, outputChunks []Chunk, index int
 		default:
 			panic(errNotImplemented)
 		}
-	}(&gDoc, keywordChunk)
+	}(doc, keywordChunk)
 
 	outputChunks = append(outputChunks, keywordChunk)
 	outputChunks = append(outputChunks, plainTextChunk)
@@ -501,28 +558,331 @@ func metaKeywordHandle(token Chunk, inputChunks, outputChunks []Chunk, index int
 	return outputChunks, newIndex, nil
 }
 
-func sectionBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+//includeKeywordHandle handles both \include file and \include{file}{id}
+func (doc *Doc) includeKeywordHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	if !followedByBlock(inputChunks, index) {
+		return doc.metaKeywordHandle(token, inputChunks, outputChunks, index)
+	}
+	fileChunks, newIndex, err := consumeEmbracedBlock(inputChunks, index)
+	if err != nil {
+		return outputChunks, index, err
+	}
+	if len(fileChunks) != 3 {
+		return outputChunks, index, errExpectPlainText
+	}
+	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
+		Keyword: token.GetValue(),
+		Value:   strings.Trim(fileChunks[1].GetValue(), BlankChars),
+	}
+	//the id is optional, \include{file} is the same as \include file
+	if followedByBlock(inputChunks, newIndex) {
+		idChunks, newIndex1, err := consumeEmbracedToken(inputChunks, newIndex)
+		if err != nil {
+			return outputChunks, index, err
+		}
+		keywordChunk.Children = []Chunk{idChunks[1]}
+		newIndex = newIndex1
+	}
+	outputChunks = append(outputChunks, keywordChunk)
+	return outputChunks, newIndex, nil
+}
+
+//indexTermBlockHandle handles \i{term}, and \i{term}{subterm}
+func (doc *Doc) indexTermBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	term, newIndex, err := consumeEmbracedText(inputChunks, index)
+	if err != nil {
+		return outputChunks, index, err
+	}
+	var subTerm string
+	if followedByBlock(inputChunks, newIndex) {
+		subTerm, newIndex, err = consumeEmbracedText(inputChunks, newIndex)
+		if err != nil {
+			return outputChunks, index, err
+		}
+	}
+
+	chunk := &IndexTermChunk{
+		Position: token.GetPosition(),
+		Term:     term,
+		SubTerm:  subTerm,
+	}
+	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
+		Keyword:  token.GetValue(),
+		Children: []Chunk{chunk},
+	}
+	outputChunks = append(outputChunks, keywordChunk)
+	return outputChunks, newIndex, nil
+}
+
+//footnoteBlockHandle handles \f{content}, the content is numbered and put in the footnote list in FootnoteChunkHandle
+func (doc *Doc) footnoteBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	chunks, newIndex, err := consumeEmbracedBlock(inputChunks, index)
+	if err != nil {
+		return outputChunks, index, err
+	}
+	chunks, err = doc.KeywordChunkHandle(chunks[1 : len(chunks)-1]) //recursive
+	if err != nil {
+		return outputChunks, index, err
+	}
+	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
+		Keyword:  token.GetValue(),
+		Children: []Chunk{&FootnoteChunk{Position: token.GetPosition(), Content: chunks}},
+	}
+	outputChunks = append(outputChunks, keywordChunk)
+	return outputChunks, newIndex, nil
+}
+
+//citeBlockHandle handles \cite{key}, and \cite{key1, key2} that cites more than one entry
+func (doc *Doc) citeBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	text, newIndex, err := consumeEmbracedText(inputChunks, index)
+	if err != nil {
+		return outputChunks, index, err
+	}
+	chunk := &CiteChunk{Position: token.GetPosition()}
+	for _, key := range strings.Split(text, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			chunk.Keys = append(chunk.Keys, key)
+		}
+	}
+	if len(chunk.Keys) == 0 {
+		return outputChunks, index, errExpectPlainText
+	}
+	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
+		Keyword:  token.GetValue(),
+		Children: []Chunk{chunk},
+	}
+	outputChunks = append(outputChunks, keywordChunk)
+	return outputChunks, newIndex, nil
+}
+
+//bibliographyBlockHandle handles \bibliography{file}, the file is searched in the same way as included files
+func (doc *Doc) bibliographyBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	name, newIndex, err := consumeEmbracedText(inputChunks, index)
+	if err != nil {
+		return outputChunks, index, err
+	}
+	file, err := doc.findIncludedFile("bibliography file", name)
+	if err != nil {
+		return outputChunks, index, err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return outputChunks, index, err
+	}
+	entries, err := parseBibTeX(string(content))
+	if err != nil {
+		return outputChunks, index, fmt.Errorf("%s: %w", file, err)
+	}
+	for _, entry := range entries {
+		if doc.bibEntries[entry.Key] == nil {
+			doc.bibEntries[entry.Key] = entry
+		}
+	}
+	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
+		Keyword:  token.GetValue(),
+		Children: []Chunk{&BibliographyChunk{Position: token.GetPosition(), File: file, Entries: entries}},
+	}
+	outputChunks = append(outputChunks, keywordChunk)
+	return outputChunks, newIndex, nil
+}
+
+//consumeEmbracedText consumes {text}, the text must be plain text and not empty. The blanks around it are trimmed.
+func consumeEmbracedText(inputChunks []Chunk, index int) (text string, newIndex int, err error) {
+	chunks, newIndex, err := consumeEmbracedBlock(inputChunks, index)
+	if err != nil {
+		return "", index, err
+	}
+	if len(chunks) != 3 {
+		return "", index, errExpectPlainText
+	}
+	plainTextChunk, ok := chunks[1].(*PlainTextChunk)
+	if !ok || strings.TrimSpace(plainTextChunk.Value) == "" {
+		return "", index, errExpectPlainText
+	}
+	return strings.TrimSpace(plainTextChunk.Value), newIndex, nil
+}
+
+// tableRows splits the content of \table into rows by \tr and line ending, and a row into cells by \d.
+// If explicitRows is set, only \tr ends a row, and the line endings are kept in the cells.
+// A cell holds every chunk between the delimiters, so it may contain inline chunks. Blank rows are ignored.
+func tableRows(chunks []Chunk, explicitRows bool) [][]*TableCell {
+	var (
+		rows [][]*TableCell
+		row  []*TableCell
+		cell = newTableCell(0)
+	)
+	endCell := func(pos int) {
+		trimTableCell(cell)
+		row = append(row, cell)
+		cell = newTableCell(pos)
+	}
+	endRow := func(pos int) {
+		endCell(pos)
+		if len(row) > 1 || len(row[0].Value) > 0 || row[0].ColSpan > 1 || row[0].RowSpan > 1 {
+			rows = append(rows, row)
+		}
+		row = nil
+	}
+	if len(chunks) > 0 {
+		cell.Position = chunks[0].GetPosition()
+	}
+
+	for _, chunk := range chunks {
+		if keywordChunk, ok := chunk.(*KeywordChunk); ok {
+			switch keywordChunk.Keyword {
+			case TableCellDelimiterKeyword:
+				endCell(chunk.GetPosition() + len(EscapeChar+TableCellDelimiterKeyword))
+				continue
+			case TableRowDelimiterKeyword:
+				endRow(chunk.GetPosition() + len(EscapeChar+TableRowDelimiterKeyword))
+				continue
+			case TableSpanKeyword:
+				spanChunk := keywordChunk.Children[0].(*TableSpanChunk)
+				cell.ColSpan, cell.RowSpan = spanChunk.ColSpan, spanChunk.RowSpan
+				continue
+			}
+		}
+		plainTextChunk, ok := chunk.(*PlainTextChunk)
+		if !ok || explicitRows {
+			cell.Value = append(cell.Value, chunk)
+			continue
+		}
+		pos := plainTextChunk.Position
+		for i, line := range strings.Split(plainTextChunk.Value, LineFeed) {
+			if i > 0 {
+				endRow(pos)
+			}
+			if line != "" {
+				cell.Value = append(cell.Value, &PlainTextChunk{Position: pos, Value: line})
+			}
+			pos += len(line) + len(LineFeed)
+		}
+	}
+	endRow(0)
+	return rows
+}
+
+// tableSpanBlockHandle handles {cols} or {cols}{rows} following \span
+func (doc *Doc) tableSpanBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	spanChunk := &TableSpanChunk{Position: token.GetPosition(), ColSpan: 1, RowSpan: 1}
+	newIndex = index
+	for i, span := range []*int{&spanChunk.ColSpan, &spanChunk.RowSpan} {
+		if i > 0 && !followedByBlock(inputChunks, newIndex) {
+			break
+		}
+		var text string
+		text, newIndex, err = consumeEmbracedText(inputChunks, newIndex)
+		if err != nil {
+			return outputChunks, index, err
+		}
+		*span, err = strconv.Atoi(text)
+		if err != nil || *span < 1 {
+			return outputChunks, index, fmt.Errorf("%w, got %q", errInvalidTableSpan, text)
+		}
+	}
+
+	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
+		Keyword:  token.GetValue(),
+		Children: []Chunk{spanChunk},
+	}
+	outputChunks = append(outputChunks, keywordChunk)
+	return outputChunks, newIndex, nil
+}
+
+// trimTableCell removes the blanks around the content of cell, the blanks between the chunks are kept
+func trimTableCell(cell *TableCell) {
+	for len(cell.Value) > 0 {
+		first, ok := cell.Value[0].(*PlainTextChunk)
+		if !ok {
+			break
+		}
+		value := strings.TrimLeft(first.Value, BlankChars)
+		if value != "" {
+			cell.Value[0] = &PlainTextChunk{Position: first.Position + len(first.Value) - len(value), Value: value}
+			break
+		}
+		cell.Value = cell.Value[1:]
+	}
+	for len(cell.Value) > 0 {
+		last, ok := cell.Value[len(cell.Value)-1].(*PlainTextChunk)
+		if !ok {
+			break
+		}
+		value := strings.TrimRight(last.Value, BlankChars)
+		if value != "" {
+			cell.Value[len(cell.Value)-1] = &PlainTextChunk{Position: last.Position, Value: value}
+			break
+		}
+		cell.Value = cell.Value[:len(cell.Value)-1]
+	}
+	if len(cell.Value) > 0 {
+		cell.Position = cell.Value[0].GetPosition()
+	}
+}
+
+// consumeRawText consumes either the content in braces or raw text, and returns the text as it is written
+func consumeRawText(inputChunks []Chunk, index int) (text string, newIndex int, err error) {
+	chunks, newIndex, err := consumeEmbracedBlock(inputChunks, index)
+	if err == nil {
+		for _, chunk := range chunks[1 : len(chunks)-1] {
+			text += chunk.GetValue()
+		}
+		return text, newIndex, nil
+	}
+	if err == errUnexpectedBlank {
+		return "", index, err
+	}
+	newIndex, err = ignoreSeparator(inputChunks, index)
+	if err != nil {
+		return "", index, err
+	}
+	if newIndex >= len(inputChunks) {
+		return "", index, errIndexOutOfBound
+	}
+	rawTextChunk, ok := inputChunks[newIndex].(*RawTextChunk)
+	if !ok {
+		return "", index, errExpectRawText
+	}
+	return rawTextChunk.GetValue(), newIndex + 1, nil
+}
+
+// blockText returns the text of the embraced block chunks, which is expected to be plain text or nothing
+func blockText(chunks []Chunk) (string, error) {
+	var text string
+	for _, chunk := range chunks[1 : len(chunks)-1] {
+		plainTextChunk, ok := chunk.(*PlainTextChunk)
+		if !ok {
+			return "", errExpectPlainText
+		}
+		text += plainTextChunk.Value
+	}
+	return text, nil
+}
+
+//followedByBlock reports whether a block(i.e. left brace) is at index, the separator before it is ignored
+func followedByBlock(inputChunks []Chunk, index int) bool {
+	next, err := ignoreSeparator(inputChunks, index)
+	return err == nil && next < len(inputChunks) && isMetaChar(inputChunks[next], LeftBraceChar)
+}
+
+func (doc *Doc) sectionBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	header := token.GetValue()
 	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
 
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
-	if newIndex > len(inputChunks) {
-		log.Fatalln(errIndexOutOfBound)
+	if newIndex >= len(inputChunks) {
 		return outputChunks, index, errIndexOutOfBound
 	}
 
 	plainTextChunk, ok := inputChunks[newIndex].(*PlainTextChunk)
 	newIndex++
 	if !ok {
-		log.Fatalln(errExpectPlainText)
 		return outputChunks, index, errExpectPlainText
 	}
 	firstLineChunk, restLineChunk, err := plainTextChunk.FirstLineRestLines()
 	if err != nil {
-		log.Fatalln(errExpectPlainText)
 		return outputChunks, index, errExpectPlainText
 	}
 	//update the plainTextChunk in-place
@@ -547,21 +907,18 @@ func sectionBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index in
 	return outputChunks, newIndex, nil
 }
 
-func listBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) listBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 	chunksContent, newIndex, err := consumeEmbracedBlock(inputChunks, newIndex)
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 
-	chunksContent, err = KeywordChunkHandle(chunksContent)
+	chunksContent, err = doc.KeywordChunkHandle(chunksContent)
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 
@@ -572,7 +929,6 @@ func listBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int)
 
 	items, _, err := consumeListItems(chunksContent[1:len(chunksContent)-1], 0)
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
 	listChunk.Items = items
@@ -584,73 +940,76 @@ func listBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int)
 	return outputChunks, newIndex, nil
 }
 
-func tableBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
-	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
+func (doc *Doc) tableBlockHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	tableChunk, newIndex, err := doc.consumeTable(token, inputChunks, index, nil)
 	if err != nil {
-		log.Fatalln(err)
 		return outputChunks, index, err
 	}
-	chunksContent, newIndex, err := consumeEmbracedBlock(inputChunks, newIndex)
-	if err != nil {
-		log.Fatalln(err)
-		return outputChunks, index, err
+
+	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
+		Keyword:  token.GetValue(),
+		Children: []Chunk{tableChunk},
 	}
+	outputChunks = append(outputChunks, keywordChunk)
+
+	return outputChunks, newIndex, nil
+}
 
-	chunksContent, err = KeywordChunkHandle(chunksContent[1 : len(chunksContent)-1])
+// consumeTable parses {id}{options}{content}, {id}{content} or {id}{file=path options} following token, i.e. \table or \chart.
+// otherOption handles the options not of table, e.g. type of \chart, it is nil if there are none.
+func (doc *Doc) consumeTable(token Chunk, inputChunks []Chunk, index int, otherOption func(key, value string) error) (tableChunk *TableChunk, newIndex int, err error) {
+	tokenChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
 	if err != nil {
-		log.Fatalln(err)
-		return outputChunks, index, err
+		return nil, index, err
 	}
-	tableChunk := &TableChunk{
+	tableChunk = &TableChunk{
 		Position: token.GetPosition(),
 		Id:       tokenChunks[1].GetValue(),
 	}
-
-	row := []Chunk{}
-	for i := 0; i < len(chunksContent); i++ {
-		chunk := chunksContent[i]
-		if keywordChunk, ok := chunk.(*KeywordChunk); ok && keywordChunk.Keyword == TableCellDelimiterKeyword {
-			continue //ignore it
+	chunksContent, newIndex, err := consumeEmbracedBlock(inputChunks, newIndex)
+	if err != nil {
+		return nil, index, err
+	}
+	//\table{id}{options}{content}, or \table{id}{file=path options} importing the rows from the file
+	if followedByBlock(inputChunks, newIndex) || isTableFileOptions(chunksContent) {
+		options, err := blockText(chunksContent)
+		if err != nil {
+			return nil, index, err
 		}
-		if plainTextChunk, ok := chunk.(*PlainTextChunk); ok {
-			firstLine, restLine, err := plainTextChunk.FirstLineRestLines()
+		err = tableChunk.setOptions(options, otherOption)
+		if err != nil {
+			//reported at the options rather than the keyword
+			return nil, index, &Diagnostic{Position: chunksContent[0].GetPosition(), Keyword: token.GetValue(), Err: err}
+		}
+		if tableChunk.File == "" {
+			chunksContent, newIndex, err = consumeEmbracedBlock(inputChunks, newIndex)
 			if err != nil {
-				return newOutputChunks, index, err
-			}
-			//empty line is ignored
-			if len(strings.Trim(firstLine.GetValue(), BlankChars)) > 0 {
-				row = append(row, firstLine)
-			}
-
-			if restLine == nil {
-				continue
-
-			}
-			if len(row) > 0 {
-				tableChunk.Cells = append(tableChunk.Cells, row)
-			}
-
-			row = []Chunk{}
-			if len(strings.Trim(restLine.GetValue(), BlankChars)) > 0 {
-				row = append(row, restLine)
+				return nil, index, err
 			}
 		}
 	}
-	if len(row) > 0 {
-		tableChunk.Cells = append(tableChunk.Cells, row)
-	}
 
-	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
-		Keyword:  token.GetValue(),
-		Children: []Chunk{tableChunk},
+	if tableChunk.File != "" {
+		tableChunk.Cells, err = doc.tableFileRows(tableChunk)
+		if err != nil {
+			return nil, index, err
+		}
+	} else {
+		chunksContent, err = doc.KeywordChunkHandle(chunksContent[1 : len(chunksContent)-1])
+		if err != nil {
+			return nil, index, err
+		}
+		tableChunk.Cells = tableRows(chunksContent, tableChunk.ExplicitRows)
 	}
-	outputChunks = append(outputChunks, keywordChunk)
-
-	return outputChunks, newIndex, nil
+	err = tableChunk.layout()
+	if err != nil {
+		return nil, index, err
+	}
+	return tableChunk, newIndex, nil
 }
 
 //only keyword itself, no following blocks
-func simpleKeywordHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+func (doc *Doc) simpleKeywordHandle(token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
 	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
 		Keyword: token.GetValue(),
 	}
@@ -675,6 +1034,21 @@ func ignoreBlank(inputChunks []Chunk, index int) (newIndex int) {
 	return
 }
 
+//ignoreSeparator skips the blanks between a keyword and its blocks, or between two blocks of a keyword.
+//Spaces, tabs and at most one line break are allowed. A blank line ends the paragraph, so it is reported
+//instead of taking the next paragraph as the block.
+func ignoreSeparator(inputChunks []Chunk, index int) (newIndex int, err error) {
+	newIndex = ignoreBlank(inputChunks, index)
+	lineFeeds := 0
+	for i := index; i < newIndex; i++ {
+		lineFeeds += strings.Count(inputChunks[i].GetValue(), LineFeed)
+	}
+	if lineFeeds > 1 {
+		return index, errUnexpectedBlank
+	}
+	return newIndex, nil
+}
+
 func consumeListItem(inputChunks []Chunk, index int) (item *ListItem, newIndex int, err error) {
 
 	index = ignoreBlank(inputChunks, index)
@@ -685,7 +1059,6 @@ func consumeListItem(inputChunks []Chunk, index int) (item *ListItem, newIndex i
 
 	listItemChunk, ok := inputChunks[index].(*KeywordChunk)
 	if !ok || listItemChunk.Keyword != ListItemMark {
-		log.Println("== listItemChunk : ", listItemChunk)
 		return nil, index, errExpectListItem
 	}
 
@@ -743,8 +1116,6 @@ func consumeListItems(inputChunks []Chunk, index int) (items []*ListItem, newInd
 
 		item, newIndex, err := consumeListItem(inputChunks, index)
 		if err != nil {
-			debug.PrintStack()
-			log.Fatalln(err)
 			return items, newIndex, err
 		}
 		items = append(items, item)
@@ -754,9 +1125,11 @@ func consumeListItems(inputChunks []Chunk, index int) (items []*ListItem, newInd
 }
 
 func consumeEmbracedBlock(inputChunks []Chunk, index int) (chunks []Chunk, newIndex int, err error) {
-	index = ignoreBlank(inputChunks, index)
+	index, err = ignoreSeparator(inputChunks, index)
+	if err != nil {
+		return nil, index, err
+	}
 	if index >= len(inputChunks) {
-		log.Println(errIndexOutOfBound)
 		return nil, index, errIndexOutOfBound
 	}
 	leftBraceChunk, ok := inputChunks[index].(*MetaCharChunk)
@@ -787,63 +1160,91 @@ func consumeEmbracedBlock(inputChunks []Chunk, index int) (chunks []Chunk, newIn
 	if ok && rightBraceChunk.GetValue() == RightBraceChar {
 		return chunks, i + 1, nil
 	}
-	log.Println(errExpectRBrace)
 	return chunks, index, errExpectRBrace
 
 }
 
+//consumeEmbracedToken consumes a token in braces, e.g. {id}. Blanks around the token are allowed, e.g. { id }.
 func consumeEmbracedToken(inputChunks []Chunk, index int) (chunks []Chunk, newIndex int, err error) {
 	chunks1, newIndex, err := consumeEmbracedBlock(inputChunks, index)
-	if len(chunks1) < 3 { //there might be empty plain-text here, so the len may be > 3
+	if err != nil {
+		return nil, index, err
+	}
 
-		debug.PrintStack()
-		log.Fatalln(errExpectToken)
-		return chunks, newIndex, errExpectToken
+	var tokenChunk *PlainTextChunk
+	for _, chunk := range chunks1[1 : len(chunks1)-1] {
+		plainTextChunk, ok := chunk.(*PlainTextChunk)
+		if !ok || tokenChunk != nil && len(strings.Trim(plainTextChunk.Value, BlankChars)) > 0 {
+			return nil, index, errExpectToken
+		}
+		if len(strings.Trim(plainTextChunk.Value, BlankChars)) > 0 {
+			tokenChunk = plainTextChunk
+		}
+	}
+	if tokenChunk == nil {
+		return nil, index, errExpectToken
+	}
+	text := strings.TrimLeft(tokenChunk.Value, BlankChars)
+	token := strings.TrimRight(text, BlankChars)
+	if gTokenPattern.FindString(token) != token {
+		return nil, index, errExpectToken
+	}
+	chunk2 := &PlainTextChunk{
+		Position: tokenChunk.Position + len(tokenChunk.Value) - len(text),
+		Value:    token,
 	}
 
-	chunks2, newIndex2, err := consumeToken(inputChunks, index+1)
+	return []Chunk{chunks1[0], chunk2, chunks1[len(chunks1)-1]}, newIndex, nil
+}
+
+//consumeFileAndId consumes {file#id}, the id is returned in the same way as consumeEmbracedToken
+func consumeFileAndId(inputChunks []Chunk, index int) (file string, chunks []Chunk, newIndex int, err error) {
+	chunks1, newIndex, err := consumeEmbracedBlock(inputChunks, index)
 	if err != nil {
-		log.Fatalln(err)
-		return nil, index, err
+		return "", nil, index, err
 	}
-	if newIndex2 >= newIndex {
-		return nil, index, errExpectPlainText
+	if len(chunks1) != 5 || !isMetaChar(chunks1[2], FillerChar) {
+		return "", nil, index, errExpectToken
 	}
-
-	return []Chunk{chunks1[0], chunks2[0], chunks1[len(chunks1)-1]}, newIndex, nil
+	fileChunk, ok1 := chunks1[1].(*PlainTextChunk)
+	idChunk, ok2 := chunks1[3].(*PlainTextChunk)
+	if !ok1 || !ok2 {
+		return "", nil, index, errExpectToken
+	}
+	file = strings.TrimLeft(fileChunk.Value, BlankChars)
+	id := strings.TrimRight(idChunk.Value, BlankChars)
+	if file == "" || id == "" || gTokenPattern.FindString(id) != id {
+		return "", nil, index, errExpectToken
+	}
+	return file, []Chunk{chunks1[0], &PlainTextChunk{Position: idChunk.Position, Value: id}, chunks1[4]}, newIndex, nil
 }
 
+//consumeToken consumes the keyword token right after the escape char, no blank is allowed between them.
+//The rest of the plainTextChunk, including the blanks following the token, is kept for the keyword handler.
 func consumeToken(inputChunks []Chunk, index int) (chunks []Chunk, newIndex int, err error) {
-
-	index = ignoreBlank(inputChunks, index)
 	if index >= len(inputChunks) {
-		log.Fatalln(errIndexOutOfBound)
 		return nil, index, errIndexOutOfBound
 	}
 	plainTextChunk, ok := inputChunks[index].(*PlainTextChunk)
 	if !ok {
-		log.Fatalln(errExpectToken)
 		return nil, index, errExpectToken
 	}
 
-	text := strings.TrimLeft(plainTextChunk.GetValue(), BlankChars)
-	delta := len(plainTextChunk.GetValue()) - len(text)
+	text := plainTextChunk.GetValue()
 	token := gTokenPattern.FindString(text)
 	if strings.HasPrefix(text, token) && len(token) > 0 {
 		newPlainText := &PlainTextChunk{}
 		newPlainText.Position = plainTextChunk.GetPosition()
 		newPlainText.Value = token
 
-		plainTextChunk.SetPosition(plainTextChunk.GetPosition() + delta + len(token))
-		plainTextChunk.Value = plainTextChunk.Value[delta+len(token):]
-		if len(strings.Trim(plainTextChunk.Value, BlankChars)) == 0 {
+		plainTextChunk.SetPosition(plainTextChunk.GetPosition() + len(token))
+		plainTextChunk.Value = plainTextChunk.Value[len(token):]
+		if len(plainTextChunk.Value) == 0 {
 			newIndex = index + 1
 		} else {
 			newIndex = index //the index does not change because we splitted the plainTextChunk
 		}
 		return []Chunk{newPlainText}, newIndex, nil
 	}
-	debug.PrintStack()
-	log.Fatalln(errExpectToken)
 	return nil, index, errExpectToken
 }
@@ -0,0 +1,225 @@
+package hairtail
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	errKeywordRegistered = errors.New("keyword is registered already")
+	errInvalidKeyword    = errors.New("invalid keyword")
+)
+
+// ArgKind tells what kind of argument follows a keyword
+type ArgKind int
+
+const (
+	//TokenArg is a token in braces, e.g. the id in \table{id}
+	TokenArg ArgKind = iota
+	//BlockArg is content in braces, the keywords in it are handled too, e.g. \e{content}
+	BlockArg
+	//RawArg is either raw text or content in braces, the content is taken as it is, e.g. \c{content} or \c\r#{content}#
+	RawArg
+	//RestOfLineArg is the text up to the end of line, e.g. \title text. It must be the last argument.
+	RestOfLineArg
+)
+
+// KeywordParseFunc parses the arguments of the keyword token, which is at inputChunks[index-1].
+// It appends the parsed chunks to outputChunks, and returns the index to go on parsing.
+type KeywordParseFunc func(doc *Doc, token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error)
+
+// KeywordRenderFunc renders the parsed keyword to html
+type KeywordRenderFunc func(doc *Doc, keywordChunk *KeywordChunk) (string, error)
+
+// KeywordHandler tells hairtail how to parse and render a keyword.
+// The built-in keywords are registered in the same way, so a keyword may be added from Go code with RegisterKeyword.
+type KeywordHandler struct {
+	Keyword string    //without the escape char, e.g. "table"
+	Args    []ArgKind //the arguments following the keyword, in order
+	Inline  bool      //rendered inside a paragraph, e.g. \e; otherwise it is a block, e.g. \table
+
+	//Parse is optional. If it is nil, the arguments are parsed according to Args,
+	//and put in KeywordChunk.Args, one chunk list per argument.
+	Parse KeywordParseFunc
+	//Render is mandatory. doc.ChunkListRender may be used to render KeywordChunk.Args.
+	Render KeywordRenderFunc
+}
+
+var (
+	gKeywordHandlersLock sync.RWMutex
+	gKeywordHandlers     = make(map[string]*KeywordHandler)
+)
+
+// RegisterKeyword makes the keyword of handler available to every document compiled afterwards.
+// It is expected to be called before compiling, e.g. in init function.
+func RegisterKeyword(handler *KeywordHandler) error {
+	if gTokenPattern.FindString(handler.Keyword) != handler.Keyword || handler.Keyword == "" || handler.Keyword == RawTextChar || handler.Keyword == DefKeyword {
+		return fmt.Errorf("%w %q", errInvalidKeyword, handler.Keyword)
+	}
+	if handler.Render == nil {
+		return fmt.Errorf("%w %q: no Render", errInvalidKeyword, handler.Keyword)
+	}
+	for i, arg := range handler.Args {
+		if arg == RestOfLineArg && i != len(handler.Args)-1 {
+			return fmt.Errorf("%w %q: RestOfLineArg is not the last argument", errInvalidKeyword, handler.Keyword)
+		}
+	}
+
+	gKeywordHandlersLock.Lock()
+	defer gKeywordHandlersLock.Unlock()
+	if _, ok := gKeywordHandlers[handler.Keyword]; ok {
+		return fmt.Errorf("%w %q", errKeywordRegistered, handler.Keyword)
+	}
+	gKeywordHandlers[handler.Keyword] = handler
+	return nil
+}
+
+// unregisterKeyword removes a keyword registered by RegisterKeyword, so that tests leave the registry as they find it
+func unregisterKeyword(keyword string) {
+	gKeywordHandlersLock.Lock()
+	defer gKeywordHandlersLock.Unlock()
+	delete(gKeywordHandlers, keyword)
+}
+
+// lookupKeyword returns the handler of keyword, or nil if the keyword is not registered
+func lookupKeyword(keyword string) *KeywordHandler {
+	gKeywordHandlersLock.RLock()
+	defer gKeywordHandlersLock.RUnlock()
+	return gKeywordHandlers[keyword]
+}
+
+// parseKeywordArgs is the Parse of the keywords registered without one, it parses the arguments according to handler.Args
+func (doc *Doc) parseKeywordArgs(handler *KeywordHandler, token Chunk, inputChunks, outputChunks []Chunk, index int) (newOutputChunks []Chunk, newIndex int, err error) {
+	keywordChunk := &KeywordChunk{Position: token.GetPosition(),
+		Keyword: token.GetValue(),
+	}
+	var restChunk Chunk //the lines following RestOfLineArg
+	newIndex = index
+	for _, arg := range handler.Args {
+		var argChunks []Chunk
+		switch arg {
+		case TokenArg:
+			argChunks, newIndex, err = consumeEmbracedToken(inputChunks, newIndex)
+			if err != nil {
+				return outputChunks, index, err
+			}
+			argChunks = argChunks[1:2]
+		case BlockArg:
+			argChunks, newIndex, err = consumeEmbracedBlock(inputChunks, newIndex)
+			if err != nil {
+				return outputChunks, index, err
+			}
+			argChunks, err = doc.KeywordChunkHandle(argChunks[1 : len(argChunks)-1]) //recursive
+			if err != nil {
+				return outputChunks, index, err
+			}
+		case RawArg:
+			blockChunks, newIndex1, err := consumeEmbracedBlock(inputChunks, newIndex)
+			if err == nil {
+				newIndex = newIndex1
+				argChunks = blockChunks[1 : len(blockChunks)-1]
+				break
+			}
+			if err == errUnexpectedBlank {
+				return outputChunks, index, err
+			}
+			newIndex, err = ignoreSeparator(inputChunks, newIndex)
+			if err != nil {
+				return outputChunks, index, err
+			}
+			if newIndex >= len(inputChunks) {
+				return outputChunks, index, errIndexOutOfBound
+			}
+			rawTextChunk, ok := inputChunks[newIndex].(*RawTextChunk)
+			if !ok {
+				return outputChunks, index, errExpectRawText
+			}
+			argChunks = []Chunk{rawTextChunk}
+			newIndex++
+		case RestOfLineArg:
+			if newIndex >= len(inputChunks) {
+				argChunks = []Chunk{&PlainTextChunk{Position: token.GetPosition()}}
+				break
+			}
+			plainTextChunk, ok := inputChunks[newIndex].(*PlainTextChunk)
+			if !ok {
+				return outputChunks, index, errExpectPlainText
+			}
+			firstLineChunk, restLineChunk, err := plainTextChunk.FirstLineRestLines()
+			if err != nil {
+				return outputChunks, index, errExpectPlainText
+			}
+			keywordChunk.Value = firstLineChunk.GetValue()
+			argChunks = []Chunk{firstLineChunk}
+			restChunk = restLineChunk
+			newIndex++
+		}
+		keywordChunk.Args = append(keywordChunk.Args, argChunks)
+	}
+
+	outputChunks = append(outputChunks, keywordChunk)
+	if restChunk != nil {
+		outputChunks = append(outputChunks, restChunk)
+	}
+	return outputChunks, newIndex, nil
+}
+
+// isInlineFormat reports whether keyword is one of gInlineFormatList
+func isInlineFormat(keyword string) bool {
+	for _, f := range gInlineFormatList {
+		if f == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	builtins := []struct {
+		keywords []string
+		args     []ArgKind
+		parse    KeywordParseFunc
+	}{
+		{[]string{EmphasisFormat, StrongFormat}, []ArgKind{BlockArg}, (*Doc).inlineBlockOneParamHandle},
+		{[]string{HyperLink}, []ArgKind{BlockArg, BlockArg}, (*Doc).hyperLinkBlockHandle},
+		{[]string{ImageKeyword}, []ArgKind{TokenArg, BlockArg}, (*Doc).imageBlockHandle},
+		{[]string{InlineTex}, []ArgKind{RawArg}, (*Doc).inlineTexBlockHandle},
+		{[]string{CommentKeyword, InlineCode}, []ArgKind{RawArg}, (*Doc).inlineCodeBlockHandle}, //comment reuses the inlineCodeBlockHandle
+		{[]string{TableCellDelimiterKeyword, TableRowDelimiterKeyword, ListItemMark, SectionIndexKeyword, ImageIndexKeyword, TableIndexKeyword, ChartIndexKeyword, DiagramIndexKeyword,
+			OrderListIndexKeyword, BulletListIndexKeyword, MathIndexKeyword, CodeIndexKeyword, TermIndexKeyword}, nil, (*Doc).simpleKeywordHandle},
+		{[]string{AnchorBlock}, []ArgKind{TokenArg, BlockArg}, (*Doc).anchorBlockHandle},
+		{[]string{ReferToBlock}, []ArgKind{TokenArg}, (*Doc).referToBlockHandle},
+		{[]string{IndexTerm}, []ArgKind{BlockArg}, (*Doc).indexTermBlockHandle}, //or {term}{subterm}
+		{[]string{Footnote}, []ArgKind{BlockArg}, (*Doc).footnoteBlockHandle},
+		{[]string{CiteKeyword}, []ArgKind{BlockArg}, (*Doc).citeBlockHandle},
+		{[]string{BibliographyKeyword}, []ArgKind{BlockArg}, (*Doc).bibliographyBlockHandle},
+		{[]string{TitleKeyword, SubTitleKeyword, AuthorKeyword, CreateDateKeyword, ModifyDateKeyword, KeywordsKeyword},
+			[]ArgKind{RestOfLineArg}, (*Doc).metaKeywordHandle},
+		{[]string{IncludeKeyword}, []ArgKind{RestOfLineArg}, (*Doc).includeKeywordHandle}, //or {file}{id}
+		{[]string{BlockCode}, []ArgKind{TokenArg, RawArg}, (*Doc).blockCodeBlockHandle},
+		{[]string{BlockTex}, []ArgKind{TokenArg, RawArg}, (*Doc).blockTexBlockHandle},
+		{[]string{DiagramKeyword}, []ArgKind{TokenArg, RawArg}, (*Doc).diagramBlockHandle},
+		{[]string{SectionHeader, SectionHeader1, SectionHeader2, SectionHeader3, SectionHeader4, SectionHeader5, SectionHeader6},
+			[]ArgKind{TokenArg, RestOfLineArg}, (*Doc).sectionBlockHandle},
+		{[]string{OrderList, BulletList}, []ArgKind{TokenArg, BlockArg}, (*Doc).listBlockHandle},
+		{[]string{TableKeyword}, []ArgKind{TokenArg, BlockArg}, (*Doc).tableBlockHandle},
+		{[]string{ChartKeyword}, []ArgKind{TokenArg, BlockArg, BlockArg}, (*Doc).chartBlockHandle}, //or {id}{content}, or {id}{file=path options}
+		{[]string{TableSpanKeyword}, []ArgKind{BlockArg}, (*Doc).tableSpanBlockHandle},             //or {cols}{rows}
+		{[]string{CaptionKeyword}, []ArgKind{TokenArg, BlockArg}, (*Doc).captionBlockHandle},
+	}
+	for _, builtin := range builtins {
+		for _, keyword := range builtin.keywords {
+			err := RegisterKeyword(&KeywordHandler{
+				Keyword: keyword,
+				Args:    builtin.args,
+				Inline:  isInlineFormat(keyword),
+				Parse:   builtin.parse,
+				Render:  (*Doc).builtinKeywordRender,
+			})
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+}
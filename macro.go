@@ -0,0 +1,199 @@
+package hairtail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errMacroRecursion = errors.New("macro expands itself")
+	errMacroIsKeyword = errors.New("keyword is not able to be defined as macro")
+)
+
+// macro is defined by \def{name}{body}. #1 to #9 in body refer to the arguments of \name{arg1}{arg2}.
+type macro struct {
+	Name    string
+	Body    []Chunk //chunks between the braces, they keep the position in the definition
+	NumArgs int     //the largest #n in Body
+}
+
+// MacroChunkHandle defines the macros and expands them, before the keywords are handled.
+// The chunks of a macro body keep their positions in the definition, and the chunks of an argument keep their positions in the call,
+// so that the errors found in the expanded chunks refer to where the text is written.
+func (doc *Doc) MacroChunkHandle(inputChunks []Chunk) ([]Chunk, error) {
+	return doc.expandMacros(inputChunks, nil)
+}
+
+// expandMacros expands the macros in inputChunks, expanding is the names of the macros being expanded, to find recursion
+func (doc *Doc) expandMacros(inputChunks []Chunk, expanding []string) ([]Chunk, error) {
+	var (
+		outputChunks []Chunk
+		index        int
+		diagnostics  DiagnosticList
+	)
+
+	for index < len(inputChunks) {
+		inputChunk := inputChunks[index]
+		if !isMetaChar(inputChunk, EscapeChar) || index+1 >= len(inputChunks) {
+			outputChunks = append(outputChunks, inputChunk)
+			index++
+			continue
+		}
+		name := peekToken(inputChunks[index+1])
+		if name != DefKeyword && doc.macros[name] == nil {
+			outputChunks = append(outputChunks, inputChunk)
+			index++
+			continue
+		}
+
+		token, newIndex, err := consumeToken(inputChunks, index+1)
+		if err != nil {
+			return outputChunks, newDiagnostic(inputChunk, err) //not expected, the token is peeked already
+		}
+		var expandedChunks []Chunk
+		if name == DefKeyword {
+			newIndex, err = doc.defineMacro(inputChunks, newIndex)
+		} else {
+			expandedChunks, newIndex, err = doc.expandMacro(token[0], inputChunks, newIndex, expanding)
+		}
+		if err != nil {
+			if !diagnostics.add(newDiagnostic(token[0], err)) || doc.tooManyErrors(diagnostics) {
+				return outputChunks, diagnostics
+			}
+			index = skipToRecoveryPoint(inputChunks, newIndex)
+			continue
+		}
+		outputChunks = append(outputChunks, expandedChunks...)
+		index = newIndex
+	}
+
+	return outputChunks, diagnostics.err()
+}
+
+// defineMacro handles {name}{body} following \def
+func (doc *Doc) defineMacro(inputChunks []Chunk, index int) (newIndex int, err error) {
+	nameChunks, newIndex, err := consumeEmbracedToken(inputChunks, index)
+	if err != nil {
+		return index, err
+	}
+	name := nameChunks[1].GetValue()
+	if name == DefKeyword || name == RawTextChar || lookupKeyword(name) != nil {
+		return index, fmt.Errorf("%w %q", errMacroIsKeyword, name)
+	}
+
+	bodyChunks, newIndex, err := consumeEmbracedBlock(inputChunks, newIndex)
+	if err != nil {
+		return index, err
+	}
+	m := &macro{Name: name, Body: bodyChunks[1 : len(bodyChunks)-1]}
+	for i := range m.Body {
+		if n := macroArgNumber(m.Body, i); n > m.NumArgs {
+			m.NumArgs = n
+		}
+	}
+	doc.macros[name] = m //a macro may be defined again, the latest definition is used afterwards
+	return newIndex, nil
+}
+
+// expandMacro handles the arguments following \name, and returns the expanded chunks
+func (doc *Doc) expandMacro(token Chunk, inputChunks []Chunk, index int, expanding []string) (chunks []Chunk, newIndex int, err error) {
+	name := token.GetValue()
+	for _, e := range expanding {
+		if e == name {
+			return nil, index, fmt.Errorf("%w: %s", errMacroRecursion, strings.Join(append(expanding, name), " -> "))
+		}
+	}
+	m := doc.macros[name]
+
+	newIndex = index
+	var args [][]Chunk
+	for i := 0; i < m.NumArgs; i++ {
+		var argChunks []Chunk
+		argChunks, newIndex, err = consumeEmbracedBlock(inputChunks, newIndex)
+		if err != nil {
+			return nil, index, err
+		}
+		//the arguments are expanded where they are written, so that \name{\name{x}} is not taken as recursion
+		argChunks, err = doc.expandMacros(argChunks[1:len(argChunks)-1], expanding)
+		if err != nil {
+			return nil, index, err
+		}
+		args = append(args, argChunks)
+	}
+
+	var substituted []Chunk
+	//the handlers of keywords expect the text in braces to be one chunk, e.g. \w{http://#1}, so the plain text is merged
+	push := func(chunk Chunk) {
+		plainTextChunk, ok := chunk.(*PlainTextChunk)
+		if ok && len(substituted) > 0 {
+			if top, ok := substituted[len(substituted)-1].(*PlainTextChunk); ok {
+				top.Value += plainTextChunk.Value
+				return
+			}
+		}
+		substituted = append(substituted, cloneChunk(chunk))
+	}
+	for i := 0; i < len(m.Body); i++ {
+		n := macroArgNumber(m.Body, i)
+		if n == 0 {
+			push(m.Body[i])
+			continue
+		}
+		for _, argChunk := range args[n-1] {
+			push(argChunk)
+		}
+		//the text following the digit
+		plainTextChunk := m.Body[i+1].(*PlainTextChunk)
+		if len(plainTextChunk.Value) > 1 {
+			push(&PlainTextChunk{Position: plainTextChunk.Position + 1, Value: plainTextChunk.Value[1:]})
+		}
+		i++
+	}
+
+	nested := make([]string, len(expanding), len(expanding)+1)
+	copy(nested, expanding)
+	chunks, err = doc.expandMacros(substituted, append(nested, name))
+	return chunks, newIndex, err
+}
+
+// macroArgNumber returns n if body[i] is the # of #n, otherwise 0
+func macroArgNumber(body []Chunk, i int) int {
+	if !isMetaChar(body[i], FillerChar) || i+1 >= len(body) {
+		return 0
+	}
+	plainTextChunk, ok := body[i+1].(*PlainTextChunk)
+	if !ok || len(plainTextChunk.Value) == 0 || plainTextChunk.Value[0] < '1' || plainTextChunk.Value[0] > '9' {
+		return 0
+	}
+	return int(plainTextChunk.Value[0] - '0')
+}
+
+// peekToken returns the token at the beginning of chunk without consuming it, or "" if there is not one
+func peekToken(chunk Chunk) string {
+	plainTextChunk, ok := chunk.(*PlainTextChunk)
+	if !ok {
+		return ""
+	}
+	token := gTokenPattern.FindString(plainTextChunk.Value)
+	if !strings.HasPrefix(plainTextChunk.Value, token) {
+		return ""
+	}
+	return token
+}
+
+// cloneChunk copies the chunks of a macro before they are expanded, because the later passes change chunks in place
+func cloneChunk(chunk Chunk) Chunk {
+	switch c := chunk.(type) {
+	case *PlainTextChunk:
+		clone := *c
+		return &clone
+	case *MetaCharChunk:
+		clone := *c
+		return &clone
+	case *RawTextChunk:
+		clone := *c
+		return &clone
+	}
+	return chunk
+}
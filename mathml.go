@@ -0,0 +1,813 @@
+package hairtail
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	errUnsupportedTex = errors.New("unsupported tex")
+	errInvalidTex     = errors.New("invalid tex")
+)
+
+// the contexts a list of atoms is parsed in, they decide the tokens that end the list
+const (
+	texTop   = iota //the whole formula, rows and cells are allowed
+	texGroup        //{...}
+	texLeft         //\left ... \right
+	texEnv          //\begin{env} ... \end{env}, rows and cells are allowed
+)
+
+// the thin space between a function, e.g. \sin, and its argument
+const gTexFunctionSpace = `<mspace width="0.167em"/>`
+
+// the limits of a big operator, e.g. \sum_{i=1}^n
+const (
+	texNoLimits      = iota
+	texMovableLimits //under and over the operator in display math, beside it in inline math
+	texLimits        //always under and over, e.g. \underbrace
+)
+
+var gTexIdentifiers = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ", "varepsilon": "ε", "zeta": "ζ", "eta": "η",
+	"theta": "θ", "vartheta": "ϑ", "iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ",
+	"omicron": "ο", "pi": "π", "varpi": "ϖ", "rho": "ρ", "varrho": "ϱ", "sigma": "σ", "varsigma": "ς", "tau": "τ",
+	"upsilon": "υ", "phi": "ϕ", "varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"infty": "∞", "partial": "∂", "nabla": "∇", "emptyset": "∅", "varnothing": "∅", "hbar": "ℏ", "ell": "ℓ",
+	"aleph": "ℵ", "Re": "ℜ", "Im": "ℑ", "wp": "℘", "imath": "ı", "jmath": "ȷ", "angle": "∠", "triangle": "△",
+	"top": "⊤", "bot": "⊥",
+}
+
+// the upper case greek letters are upright
+var gTexUprightIdentifiers = map[string]string{
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π", "Sigma": "Σ", "Upsilon": "Υ",
+	"Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+}
+
+var gTexOperators = map[string]string{
+	"pm": "±", "mp": "∓", "times": "×", "div": "÷", "cdot": "⋅", "ast": "∗", "star": "⋆", "circ": "∘", "bullet": "∙",
+	"oplus": "⊕", "ominus": "⊖", "otimes": "⊗", "odot": "⊙", "cup": "∪", "cap": "∩", "setminus": "∖",
+	"wedge": "∧", "land": "∧", "vee": "∨", "lor": "∨", "neg": "¬", "lnot": "¬",
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠", "ll": "≪", "gg": "≫", "approx": "≈",
+	"equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅", "propto": "∝", "in": "∈", "notin": "∉", "ni": "∋",
+	"subset": "⊂", "subseteq": "⊆", "supset": "⊃", "supseteq": "⊇", "mid": "∣", "parallel": "∥", "perp": "⊥",
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←", "leftrightarrow": "↔", "Rightarrow": "⇒",
+	"Leftarrow": "⇐", "Leftrightarrow": "⇔", "implies": "⟹", "iff": "⟺", "mapsto": "↦", "longrightarrow": "⟶",
+	"longleftarrow": "⟵", "uparrow": "↑", "downarrow": "↓", "forall": "∀", "exists": "∃", "nexists": "∄",
+	"therefore": "∴", "because": "∵", "ldots": "…", "dots": "…", "cdots": "⋯", "vdots": "⋮", "ddots": "⋱",
+	"prime": "′", "colon": ":", "vert": "|", "Vert": "‖", "lbrace": "{", "rbrace": "}", "langle": "⟨", "rangle": "⟩",
+	"lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉", "backslash": "\\",
+	"{": "{", "}": "}", "|": "‖", "%": "%", "$": "$", "#": "#", "&": "&", "_": "_",
+}
+
+// gTexBigOperators is the big operators, and whether they take movable limits
+var gTexBigOperators = map[string]struct {
+	Text   string
+	Limits int
+}{
+	"sum": {"∑", texMovableLimits}, "prod": {"∏", texMovableLimits}, "coprod": {"∐", texMovableLimits},
+	"bigcup": {"⋃", texMovableLimits}, "bigcap": {"⋂", texMovableLimits}, "bigoplus": {"⨁", texMovableLimits},
+	"bigotimes": {"⨂", texMovableLimits}, "bigvee": {"⋁", texMovableLimits}, "bigwedge": {"⋀", texMovableLimits},
+	"int": {"∫", texNoLimits}, "iint": {"∬", texNoLimits}, "iiint": {"∭", texNoLimits}, "oint": {"∮", texNoLimits},
+}
+
+// gTexFunctions is the function names written upright, and whether they take movable limits
+var gTexFunctions = map[string]struct {
+	Text   string
+	Limits int
+}{
+	"sin": {"sin", texNoLimits}, "cos": {"cos", texNoLimits}, "tan": {"tan", texNoLimits}, "cot": {"cot", texNoLimits},
+	"sec": {"sec", texNoLimits}, "csc": {"csc", texNoLimits}, "arcsin": {"arcsin", texNoLimits},
+	"arccos": {"arccos", texNoLimits}, "arctan": {"arctan", texNoLimits}, "sinh": {"sinh", texNoLimits},
+	"cosh": {"cosh", texNoLimits}, "tanh": {"tanh", texNoLimits}, "coth": {"coth", texNoLimits},
+	"log": {"log", texNoLimits}, "ln": {"ln", texNoLimits}, "lg": {"lg", texNoLimits}, "exp": {"exp", texNoLimits},
+	"deg": {"deg", texNoLimits}, "dim": {"dim", texNoLimits}, "ker": {"ker", texNoLimits}, "arg": {"arg", texNoLimits},
+	"hom": {"hom", texNoLimits},
+	"lim": {"lim", texMovableLimits}, "limsup": {"lim sup", texMovableLimits}, "liminf": {"lim inf", texMovableLimits},
+	"max": {"max", texMovableLimits}, "min": {"min", texMovableLimits}, "sup": {"sup", texMovableLimits},
+	"inf": {"inf", texMovableLimits}, "det": {"det", texMovableLimits}, "gcd": {"gcd", texMovableLimits},
+	"Pr": {"Pr", texMovableLimits},
+}
+
+var gTexSpaces = map[string]string{
+	",": "0.167em", ":": "0.222em", ">": "0.222em", ";": "0.278em", "!": "-0.167em", " ": "0.25em",
+	"quad": "1em", "qquad": "2em", "enspace": "0.5em", "thinspace": "0.167em",
+}
+
+// gTexBigDelimiters is the sizes of \big( and the like
+var gTexBigDelimiters = map[string]string{
+	"big": "1.2em", "bigl": "1.2em", "bigr": "1.2em", "bigm": "1.2em",
+	"Big": "1.623em", "Bigl": "1.623em", "Bigr": "1.623em", "Bigm": "1.623em",
+	"bigg": "2.047em", "biggl": "2.047em", "biggr": "2.047em", "biggm": "2.047em",
+	"Bigg": "2.470em", "Biggl": "2.470em", "Biggr": "2.470em", "Biggm": "2.470em",
+}
+
+// gTexDelimiters is the delimiters written as commands after \left, \right and \big
+var gTexDelimiters = map[string]string{
+	`\{`: "{", `\}`: "}", `\|`: "‖", `\langle`: "⟨", `\rangle`: "⟩", `\lfloor`: "⌊", `\rfloor`: "⌋",
+	`\lceil`: "⌈", `\rceil`: "⌉", `\vert`: "|", `\Vert`: "‖", `\lbrace`: "{", `\rbrace`: "}",
+	`\uparrow`: "↑", `\downarrow`: "↓", `\backslash`: "\\",
+}
+
+// gTexFonts is the mathvariant of the font commands
+var gTexFonts = map[string]string{
+	"mathrm": "normal", "mathbf": "bold", "mathit": "italic", "mathbb": "double-struck", "mathcal": "script",
+	"mathscr": "script", "mathfrak": "fraktur", "mathsf": "sans-serif", "mathtt": "monospace",
+	"boldsymbol": "bold-italic", "bm": "bold-italic",
+}
+
+// gTexTextFonts is the mathvariant of the text commands, the text is written as it is
+var gTexTextFonts = map[string]string{
+	"text": "", "textrm": "", "textnormal": "", "mbox": "", "textbf": "bold", "textit": "italic",
+}
+
+var gTexAccents = map[string]struct {
+	Text     string
+	Under    bool //under the base rather than over it
+	Stretchy bool //as wide as the base
+	Limits   bool //the scripts go under and over, e.g. \underbrace{x+y}_{n}
+}{
+	"hat": {Text: "^"}, "widehat": {Text: "^", Stretchy: true}, "check": {Text: "ˇ"}, "tilde": {Text: "~"},
+	"widetilde": {Text: "~", Stretchy: true}, "bar": {Text: "¯"}, "overline": {Text: "¯", Stretchy: true},
+	"vec": {Text: "→"}, "overrightarrow": {Text: "→", Stretchy: true}, "overleftarrow": {Text: "←", Stretchy: true},
+	"dot": {Text: "˙"}, "ddot": {Text: "¨"}, "acute": {Text: "´"}, "grave": {Text: "`"}, "breve": {Text: "˘"},
+	"overbrace":  {Text: "⏞", Stretchy: true, Limits: true},
+	"underline":  {Text: "_", Under: true, Stretchy: true},
+	"underbrace": {Text: "⏟", Under: true, Stretchy: true, Limits: true},
+}
+
+// texEnvironment is how \begin{name} ... \end{name} is drawn
+type texEnvironment struct {
+	Open, Close string //the fences around the table, may be empty
+	Align       string //"" centers the cells, "left" aligns them to the left, "aligned" aligns the columns to the right and the left by turns
+}
+
+var gTexEnvironments = map[string]texEnvironment{
+	"matrix": {}, "smallmatrix": {}, "pmatrix": {Open: "(", Close: ")"}, "bmatrix": {Open: "[", Close: "]"},
+	"Bmatrix": {Open: "{", Close: "}"}, "vmatrix": {Open: "|", Close: "|"}, "Vmatrix": {Open: "‖", Close: "‖"},
+	"cases": {Open: "{", Align: "left"}, "aligned": {Align: "aligned"}, "align": {Align: "aligned"},
+	"align*": {Align: "aligned"}, "split": {Align: "aligned"}, "gathered": {}, "gather": {}, "gather*": {},
+	"array": {},
+}
+
+// texParser converts a formula in tex to MathML, see texToMathML
+type texParser struct {
+	tex      string
+	pos      int
+	display  bool
+	tag      string          //set by \tag, written at the end of the formula
+	errs     []error         //the problems found, the formula is converted anyway
+	reported map[string]bool //a problem is reported once per formula, e.g. the same unsupported command used many times
+}
+
+// texToMathML converts tex, the content of \t or \tex, to a MathML math element.
+// It covers the tex used in most documents: fractions, scripts, greek letters, big operators, matrices and aligned equations.
+// The unsupported commands are drawn as errors in the formula, and returned as errors, so that the rest of the formula is still shown.
+func texToMathML(tex string, display bool) (string, []error) {
+	p := &texParser{tex: tex, display: display, reported: make(map[string]bool)}
+	rows := p.parseRows(texTop)
+	body := rows[0][0]
+	if len(rows) > 1 || len(rows[0]) > 1 {
+		//equations written line by line without an environment, they are aligned if they have &
+		align := ""
+		for _, row := range rows {
+			if len(row) > 1 {
+				align = "aligned"
+			}
+		}
+		body = texTable(rows, align)
+	}
+	if p.tag != "" {
+		body = `<mrow>` + body + `<mspace width="2em"/><mtext>(` + html.EscapeString(p.tag) + `)</mtext></mrow>`
+	}
+	displayAttr := ""
+	if display {
+		displayAttr = ` display="block"`
+	}
+	return fmt.Sprintf(`<math xmlns="http://www.w3.org/1998/Math/MathML"%s><semantics>%s<annotation encoding="application/x-tex">%s</annotation></semantics></math>`,
+		displayAttr, body, html.EscapeString(strings.TrimSpace(tex))), p.errs
+}
+
+// errorf keeps the problem unless it is reported already
+func (p *texParser) errorf(format string, args ...interface{}) {
+	err := fmt.Errorf(format, args...)
+	if p.reported[err.Error()] {
+		return
+	}
+	p.reported[err.Error()] = true
+	p.errs = append(p.errs, err)
+}
+
+// skipSpace skips the blanks and the comments, which start with % and end at the end of the line
+func (p *texParser) skipSpace() {
+	for p.pos < len(p.tex) {
+		switch p.tex[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '%':
+			for p.pos < len(p.tex) && p.tex[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next token without consuming it, it is either a command, e.g. \frac or \{, or a char, "" at the end
+func (p *texParser) peek() string {
+	p.skipSpace()
+	if p.pos >= len(p.tex) {
+		return ""
+	}
+	if p.tex[p.pos] == '\\' {
+		end := p.pos + 1
+		for end < len(p.tex) && isASCIILetter(p.tex[end]) {
+			end++
+		}
+		if end == p.pos+1 && end < len(p.tex) {
+			_, size := utf8.DecodeRuneInString(p.tex[end:])
+			end += size
+		}
+		return p.tex[p.pos:end]
+	}
+	_, size := utf8.DecodeRuneInString(p.tex[p.pos:])
+	return p.tex[p.pos : p.pos+size]
+}
+
+// next consumes the next token
+func (p *texParser) next() string {
+	token := p.peek()
+	p.pos += len(token)
+	return token
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isASCIIDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// texRow puts nodes in an mrow, unless there is only one of them
+func texRow(nodes []string) string {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	return "<mrow>" + strings.Join(nodes, "") + "</mrow>"
+}
+
+// parseList parses the atoms up to the token that ends the list in ctx, which is left for the caller.
+// The tokens not allowed in ctx are reported and skipped.
+func (p *texParser) parseList(ctx int) []string {
+	var nodes []string
+	for {
+		token := p.peek()
+		switch token {
+		case "":
+			return nodes
+		case "}":
+			if ctx == texGroup {
+				return nodes
+			}
+			p.next()
+			p.errorf("%w: unexpected }", errInvalidTex)
+		case "&", `\\`:
+			if ctx == texTop || ctx == texEnv {
+				return nodes
+			}
+			p.next()
+			p.errorf("%w: unexpected %s", errInvalidTex, token)
+		case `\right`:
+			if ctx == texLeft {
+				return nodes
+			}
+			p.next()
+			p.parseDelimiter(token)
+			p.errorf("%w: \\right without \\left", errInvalidTex)
+		case `\end`:
+			if ctx == texEnv {
+				return nodes
+			}
+			p.next()
+			p.errorf("%w: \\end{%s} without \\begin", errInvalidTex, p.readGroupText(token))
+		default:
+			if node := p.parseAtom(); node != "" {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+}
+
+// parseRows parses the cells separated by & and the rows separated by \\, there is at least one cell
+func (p *texParser) parseRows(ctx int) [][]string {
+	rows := [][]string{nil}
+	for {
+		last := len(rows) - 1
+		rows[last] = append(rows[last], texRow(p.parseList(ctx)))
+		switch p.peek() {
+		case "&":
+			p.next()
+		case `\\`:
+			p.next()
+			if p.peek() == "[" {
+				p.readBracketText() //the space between the rows, e.g. \\[2pt]
+			}
+			rows = append(rows, nil)
+		default:
+			//a \\ at the end of the last row does not start another row
+			if len(rows) > 1 && len(rows[last]) == 1 && rows[last][0] == texRow(nil) {
+				rows = rows[:last]
+			}
+			return rows
+		}
+	}
+}
+
+// parseAtom parses a base and its scripts, it returns "" for the commands that draw nothing, e.g. \label
+func (p *texParser) parseAtom() string {
+	base, limits, function := p.parseBase()
+	var subs, sups []string
+	superscript := false //primes may be followed by a superscript, e.g. f'^2, but not a superscript by another
+	for scripts := true; scripts; {
+		switch token := p.peek(); token {
+		case "_":
+			p.next()
+			if len(subs) > 0 {
+				p.errorf("%w: double subscript", errInvalidTex)
+			}
+			subs = append(subs, p.parseArg(token))
+		case "^":
+			p.next()
+			if superscript {
+				p.errorf("%w: double superscript", errInvalidTex)
+			}
+			superscript = true
+			sups = append(sups, p.parseArg(token))
+		case "'":
+			p.next()
+			sups = append(sups, "<mo>′</mo>")
+		case `\limits`:
+			p.next()
+			limits = texLimits
+		case `\nolimits`:
+			p.next()
+			limits = texNoLimits
+		default:
+			scripts = false
+		}
+	}
+	function = p.functionSpace(function)
+	if len(subs) == 0 && len(sups) == 0 {
+		return base + function
+	}
+	if base == "" {
+		base = texRow(nil)
+	}
+	under, over := "msub", "msup"
+	if limits == texLimits || limits == texMovableLimits && p.display {
+		under, over = "munder", "mover"
+	}
+	switch {
+	case len(sups) == 0:
+		return "<" + under + ">" + base + texRow(subs) + "</" + under + ">" + function
+	case len(subs) == 0:
+		return "<" + over + ">" + base + texRow(sups) + "</" + over + ">" + function
+	case under == "munder":
+		return "<munderover>" + base + texRow(subs) + texRow(sups) + "</munderover>" + function
+	default:
+		return "<msubsup>" + base + texRow(subs) + texRow(sups) + "</msubsup>" + function
+	}
+}
+
+// parseBase parses the base of an atom, function is put after the scripts of the base, e.g. the space after \sin
+func (p *texParser) parseBase() (node string, limits int, function string) {
+	token := p.peek()
+	switch {
+	case token == "" || token == "_" || token == "^" || token == "'":
+		return "", texNoLimits, ""
+	case token == "{":
+		p.next()
+		return p.parseGroupRest(), texNoLimits, ""
+	case len(token) > 1 && token[0] == '\\':
+		p.next()
+		return p.parseCommand(token)
+	case isASCIIDigit(token[0]):
+		return p.parseNumber(), texNoLimits, ""
+	}
+	p.next()
+	r, _ := utf8.DecodeRuneInString(token)
+	switch {
+	case unicode.IsLetter(r):
+		return "<mi>" + html.EscapeString(token) + "</mi>", texNoLimits, ""
+	case token == "~":
+		return "<mtext>\u00a0</mtext>", texNoLimits, ""
+	case token == "-":
+		return "<mo>−</mo>", texNoLimits, ""
+	case token == "*":
+		return "<mo>∗</mo>", texNoLimits, ""
+	case token == "#" || token == "$" || token == `\`:
+		p.errorf("%w: unexpected %s", errInvalidTex, token)
+		return "", texNoLimits, ""
+	}
+	return "<mo>" + html.EscapeString(token) + "</mo>", texNoLimits, ""
+}
+
+// functionSpace returns the space between a function and its argument, if the argument follows, and not in parentheses
+func (p *texParser) functionSpace(function string) string {
+	switch p.peek() {
+	case "(", "[", `\left`, "", "}", "&", `\\`, `\right`, `\end`:
+		return ""
+	}
+	return function
+}
+
+// parseNumber parses digits with an optional decimal point, e.g. 3.14
+func (p *texParser) parseNumber() string {
+	start := p.pos
+	for p.pos < len(p.tex) && (isASCIIDigit(p.tex[p.pos]) ||
+		p.tex[p.pos] == '.' && p.pos+1 < len(p.tex) && isASCIIDigit(p.tex[p.pos+1])) {
+		p.pos++
+	}
+	return "<mn>" + p.tex[start:p.pos] + "</mn>"
+}
+
+// parseGroupRest parses the group whose { is consumed already
+func (p *texParser) parseGroupRest() string {
+	node := texRow(p.parseList(texGroup))
+	if p.peek() == "}" {
+		p.next()
+	} else {
+		p.errorf("%w: missing }", errInvalidTex)
+	}
+	return node
+}
+
+// parseArg parses the argument of command, which is a group or a single token, e.g. \frac12 or x^\alpha
+func (p *texParser) parseArg(command string) string {
+	token := p.peek()
+	switch {
+	case token == "{":
+		p.next()
+		return p.parseGroupRest()
+	case token == "" || token == "}" || token == "&" || token == `\\` || token == "_" || token == "^" ||
+		token == `\right` || token == `\end`:
+		p.errorf("%w: missing argument of %s", errInvalidTex, command)
+		return texRow(nil)
+	case isASCIIDigit(token[0]):
+		p.next()
+		return "<mn>" + token + "</mn>"
+	}
+	//an argument is one element, so the space after a function is dropped, e.g. \frac\sin x
+	node, _, _ := p.parseBase()
+	if node == "" {
+		return texRow(nil)
+	}
+	return node
+}
+
+// readGroupText returns the text of the group that follows command as it is, or the next token if there is no group
+func (p *texParser) readGroupText(command string) string {
+	token := p.peek()
+	if token != "{" {
+		if token == "" {
+			p.errorf("%w: missing argument of %s", errInvalidTex, command)
+		}
+		return p.next()
+	}
+	depth := 0
+	for i := p.pos; i < len(p.tex); i++ {
+		switch p.tex[i] {
+		case '\\':
+			i++ //\{ and \} are not braces of the group
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				text := p.tex[p.pos+1 : i]
+				p.pos = i + 1
+				return text
+			}
+		}
+	}
+	p.errorf("%w: missing }", errInvalidTex)
+	text := p.tex[p.pos+1:]
+	p.pos = len(p.tex)
+	return text
+}
+
+// readBracketText returns the text of the optional argument in brackets, e.g. the 3 of \sqrt[3]{x}
+func (p *texParser) readBracketText() string {
+	p.next()
+	end := strings.Index(p.tex[p.pos:], "]")
+	if end < 0 {
+		p.errorf("%w: missing ]", errInvalidTex)
+		end = len(p.tex) - p.pos
+	}
+	text := p.tex[p.pos : p.pos+end]
+	p.pos += end
+	if p.pos < len(p.tex) {
+		p.pos++
+	}
+	return text
+}
+
+// parseText parses a part of the formula apart, e.g. the optional argument of \sqrt
+func (p *texParser) parseText(text string) string {
+	sub := &texParser{tex: text, display: p.display, reported: p.reported}
+	node := texRow(sub.parseList(texGroup))
+	if sub.peek() != "" {
+		sub.errorf("%w: unexpected %s", errInvalidTex, sub.peek())
+	}
+	p.errs = append(p.errs, sub.errs...)
+	return node
+}
+
+// parseDelimiter parses the delimiter after \left, \right, \middle and \big, "" for the null delimiter .
+func (p *texParser) parseDelimiter(command string) string {
+	token := p.next()
+	if delimiter, ok := gTexDelimiters[token]; ok {
+		return delimiter
+	}
+	switch token {
+	case ".":
+		return ""
+	case "(", ")", "[", "]", "|", "/":
+		return token
+	case "<":
+		return "⟨"
+	case ">":
+		return "⟩"
+	case "":
+		p.errorf("%w: missing delimiter after %s", errInvalidTex, command)
+	default:
+		p.errorf("%w: %s is not a delimiter", errInvalidTex, token)
+	}
+	return ""
+}
+
+// texFence draws a delimiter as tall as the content between the delimiters
+func texFence(delimiter string) string {
+	if delimiter == "" {
+		return ""
+	}
+	return `<mo fence="true" stretchy="true">` + html.EscapeString(delimiter) + `</mo>`
+}
+
+// parseCommand parses command, e.g. \frac, and its arguments
+func (p *texParser) parseCommand(command string) (node string, limits int, function string) {
+	name := command[1:]
+	if text, ok := gTexIdentifiers[name]; ok {
+		return "<mi>" + text + "</mi>", texNoLimits, ""
+	}
+	if text, ok := gTexUprightIdentifiers[name]; ok {
+		return `<mi mathvariant="normal">` + text + "</mi>", texNoLimits, ""
+	}
+	if text, ok := gTexOperators[name]; ok {
+		return "<mo>" + html.EscapeString(text) + "</mo>", texNoLimits, ""
+	}
+	if op, ok := gTexBigOperators[name]; ok {
+		return "<mo>" + op.Text + "</mo>", op.Limits, ""
+	}
+	if f, ok := gTexFunctions[name]; ok {
+		return "<mi>" + f.Text + "</mi>", f.Limits, gTexFunctionSpace
+	}
+	if width, ok := gTexSpaces[name]; ok {
+		return `<mspace width="` + width + `"/>`, texNoLimits, ""
+	}
+	if size, ok := gTexBigDelimiters[name]; ok {
+		delimiter := html.EscapeString(p.parseDelimiter(command))
+		return `<mo minsize="` + size + `" maxsize="` + size + `">` + delimiter + "</mo>", texNoLimits, ""
+	}
+	if variant, ok := gTexFonts[name]; ok {
+		return p.parseFont(command, variant), texNoLimits, ""
+	}
+	if variant, ok := gTexTextFonts[name]; ok {
+		text := p.readGroupText(command)
+		//the blanks at the ends of a token element are dropped by the browsers, so they are kept as no-break spaces
+		if trimmed := strings.TrimLeft(text, " "); trimmed != text {
+			text = "\u00a0" + trimmed
+		}
+		if trimmed := strings.TrimRight(text, " "); trimmed != text {
+			text = trimmed + "\u00a0"
+		}
+		if variant != "" {
+			return `<mtext mathvariant="` + variant + `">` + html.EscapeString(text) + "</mtext>", texNoLimits, ""
+		}
+		return "<mtext>" + html.EscapeString(text) + "</mtext>", texNoLimits, ""
+	}
+	if accent, ok := gTexAccents[name]; ok {
+		base := p.parseArg(command)
+		mark := "<mo>" + html.EscapeString(accent.Text) + "</mo>"
+		if accent.Stretchy {
+			mark = `<mo stretchy="true">` + html.EscapeString(accent.Text) + "</mo>"
+		}
+		if accent.Limits {
+			limits = texLimits
+		}
+		if accent.Under {
+			return `<munder accentunder="true">` + base + mark + "</munder>", limits, ""
+		}
+		return `<mover accent="true">` + base + mark + "</mover>", limits, ""
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		numerator := p.parseArg(command)
+		denominator := p.parseArg(command)
+		node = "<mfrac>" + numerator + denominator + "</mfrac>"
+		switch name {
+		case "dfrac", "cfrac":
+			node = `<mstyle displaystyle="true">` + node + "</mstyle>"
+		case "tfrac":
+			node = `<mstyle displaystyle="false">` + node + "</mstyle>"
+		}
+		return node, texNoLimits, ""
+	case "binom", "dbinom", "tbinom":
+		n := p.parseArg(command)
+		k := p.parseArg(command)
+		return `<mrow><mo>(</mo><mfrac linethickness="0">` + n + k + `</mfrac><mo>)</mo></mrow>`, texNoLimits, ""
+	case "sqrt":
+		if p.peek() == "[" {
+			index := p.parseText(p.readBracketText())
+			return "<mroot>" + p.parseArg(command) + index + "</mroot>", texNoLimits, ""
+		}
+		return "<msqrt>" + p.parseArg(command) + "</msqrt>", texNoLimits, ""
+	case "left":
+		open := p.parseDelimiter(command)
+		nodes := p.parseList(texLeft)
+		close := ""
+		if p.peek() == `\right` {
+			p.next()
+			close = p.parseDelimiter(`\right`)
+		} else {
+			p.errorf("%w: \\left without \\right", errInvalidTex)
+		}
+		return "<mrow>" + texFence(open) + strings.Join(nodes, "") + texFence(close) + "</mrow>", texNoLimits, ""
+	case "middle":
+		return `<mo stretchy="true">` + html.EscapeString(p.parseDelimiter(command)) + "</mo>", texNoLimits, ""
+	case "begin":
+		return p.parseEnvironment(), texNoLimits, ""
+	case "operatorname":
+		if p.peek() == "*" {
+			p.next()
+			limits = texMovableLimits
+		}
+		return "<mi>" + html.EscapeString(p.readGroupText(command)) + "</mi>", limits, gTexFunctionSpace
+	case "overset", "stackrel":
+		over := p.parseArg(command)
+		return "<mover>" + p.parseArg(command) + over + "</mover>", texNoLimits, ""
+	case "underset":
+		under := p.parseArg(command)
+		return "<munder>" + p.parseArg(command) + under + "</munder>", texNoLimits, ""
+	case "not":
+		//a slash through the next relation, e.g. \not= or \not\in
+		switch p.peek() {
+		case "=":
+			p.next()
+			return "<mo>≠</mo>", texNoLimits, ""
+		case `\in`:
+			p.next()
+			return "<mo>∉</mo>", texNoLimits, ""
+		}
+		node, limits, function = p.parseBase()
+		if strings.HasPrefix(node, "<mo>") {
+			node = strings.TrimSuffix(node, "</mo>") + "̸</mo>"
+		}
+		return node, limits, function
+	case "pmod":
+		return `<mrow><mspace width="1em"/><mo>(</mo><mi>mod</mi><mspace width="0.333em"/>` + p.parseArg(command) + `<mo>)</mo></mrow>`, texNoLimits, ""
+	case "bmod", "mod":
+		return `<mo lspace="0.278em" rspace="0.278em">mod</mo>`, texNoLimits, ""
+	case "tag":
+		if p.peek() == "*" {
+			p.next()
+		}
+		p.tag = p.readGroupText(command)
+		return "", texNoLimits, ""
+	case "label":
+		p.readGroupText(command)
+		return "", texNoLimits, ""
+	case "nonumber", "notag", "displaystyle", "textstyle", "scriptstyle", "hline", "limits", "nolimits":
+		//they change nothing in MathML, or only the look of the formula
+		return "", texNoLimits, ""
+	}
+	p.errorf("%w command %s", errUnsupportedTex, command)
+	return "<merror><mtext>" + html.EscapeString(command) + "</mtext></merror>", texNoLimits, ""
+}
+
+// parseFont parses the argument of a font command, e.g. \mathbb{R}
+func (p *texParser) parseFont(command, variant string) string {
+	if p.peek() == "{" {
+		if end := strings.IndexByte(p.tex[p.pos:], '}'); end > 1 && isTexWord(p.tex[p.pos+1:p.pos+end]) {
+			text := p.tex[p.pos+1 : p.pos+end]
+			p.pos += end + 1
+			return `<mi mathvariant="` + variant + `">` + text + "</mi>"
+		}
+	}
+	//the argument is more than letters, e.g. \mathbf{x+1}
+	return `<mstyle mathvariant="` + variant + `">` + p.parseArg(command) + "</mstyle>"
+}
+
+// isTexWord reports whether text is made of ASCII letters and digits only
+func isTexWord(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if !isASCIILetter(text[i]) && !isASCIIDigit(text[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseEnvironment parses \begin{name} ... \end{name}, whose \begin is consumed already
+func (p *texParser) parseEnvironment() string {
+	name := p.readGroupText(`\begin`)
+	env, ok := gTexEnvironments[name]
+	if !ok {
+		p.errorf("%w environment %s", errUnsupportedTex, name)
+	}
+	align := env.Align
+	if name == "array" {
+		//the column spec, e.g. {lcr}, the other chars, e.g. | between the columns, are ignored
+		for _, c := range p.readGroupText(`\begin{array}`) {
+			switch c {
+			case 'l':
+				align += "left "
+			case 'c':
+				align += "center "
+			case 'r':
+				align += "right "
+			}
+		}
+		align = strings.TrimSpace(align)
+	}
+	rows := p.parseRows(texEnv)
+	if p.peek() == `\end` {
+		p.next()
+		if end := p.readGroupText(`\end`); end != name {
+			p.errorf("%w: \\begin{%s} ended by \\end{%s}", errInvalidTex, name, end)
+		}
+	} else {
+		p.errorf("%w: missing \\end{%s}", errInvalidTex, name)
+	}
+	table := texTable(rows, align)
+	if !ok {
+		return "<merror>" + table + "</merror>"
+	}
+	if env.Open == "" && env.Close == "" {
+		return table
+	}
+	return "<mrow>" + texFence(env.Open) + table + texFence(env.Close) + "</mrow>"
+}
+
+// texTable draws rows as a table, align is "", "left", "aligned" or the alignments of the columns separated by blanks
+func texTable(rows [][]string, align string) string {
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	var buf strings.Builder
+	buf.WriteString("<mtable")
+	switch align {
+	case "":
+	case "left":
+		buf.WriteString(` columnalign="left"`)
+	case "aligned":
+		//the relations line up, e.g. the = of a&=b, so the left column of every pair aligns to the right, and no space between them
+		var aligns, spacings []string
+		for col := 0; col < columns; col++ {
+			if col%2 == 0 {
+				aligns = append(aligns, "right")
+			} else {
+				aligns = append(aligns, "left")
+			}
+			if col > 0 {
+				spacings = append(spacings, []string{"0em", "2em"}[(col-1)%2])
+			}
+		}
+		buf.WriteString(` displaystyle="true" columnalign="` + strings.Join(aligns, " ") + `"`)
+		if len(spacings) > 0 {
+			buf.WriteString(` columnspacing="` + strings.Join(spacings, " ") + `"`)
+		}
+	default:
+		buf.WriteString(` columnalign="` + align + `"`)
+	}
+	buf.WriteString(">")
+	for _, row := range rows {
+		buf.WriteString("<mtr>")
+		for _, cell := range row {
+			buf.WriteString("<mtd>" + cell + "</mtd>")
+		}
+		buf.WriteString("</mtr>")
+	}
+	buf.WriteString("</mtable>")
+	return buf.String()
+}
@@ -1,8 +1,9 @@
-package main
+package hairtail
 
 import (
 	"bytes"
 	"log"
+	"sort"
 	"text/template"
 )
 
@@ -24,41 +25,61 @@ var (
 	gTableTemplate        *template.Template
 	gTableRowTemplate     *template.Template
 	gTableCellTemplate    *template.Template
+	gTableGroupTemplate   *template.Template
 	gImageTemplate        *template.Template
+	gChartTemplate        *template.Template
+	gDiagramTemplate      *template.Template
 	gSectionIndexTemplate *template.Template
+	gIndexTermTemplate    *template.Template
+	gFootnoteTemplate     *template.Template
+	gFootnoteListTemplate *template.Template
+	gCiteTemplate         *template.Template
+	gBibliographyTemplate *template.Template
+	gTermIndexTemplate    *template.Template
 	gGlobalIndexTemplate  *template.Template //to generate index for entities other than section
 	gTitleTemplate        *template.Template
 	gMetaDataTemplate     *template.Template
-
-	gInlineRenderMode bool
 )
 
 func init() {
-	gSectionTemplate, _ = template.New("Section").Parse(`<h{{.Level}} id="{{.Id}}">{{.Numbering}} {{.Caption}}</h{{.Level}}>` + "\n")
+	gSectionTemplate, _ = template.New("Section").Parse(`<section class="section{{.Level}}">` + "\n" + `<h{{.Level}} id="{{.Id}}">{{.Numbering}} {{.Caption}}</h{{.Level}}>` + "\n" + `{{.Content}}</section>` + "\n")
 	gParagraphTemplate, _ = template.New("Paragraph").Parse(`<p>{{.}}</p>` + "\n")
 	gEmphasisTemplate, _ = template.New("Emphasis").Parse(`<em>{{.}}</em>`)
 	gStrongTemplate, _ = template.New("Strong").Parse(`<strong>{{.}}</strong>`)
 	gHyperLinkTemplate, _ = template.New("HyperLink").Parse(`<a href="{{.Url}}">{{.Text}}</a>`)
-	gInlineTexTemplate, _ = template.New("InlineTex").Parse(`<span class="inline-tex">\({{.}}\)</span>`) //need mathjax to support this
+	gInlineTexTemplate, _ = template.New("InlineTex").Parse(`<span class="inline-tex">{{if .MathML}}{{.MathML}}{{else}}\({{.Value}}\){{end}}</span>`) //the tex is left to mathjax if there is no MathML
 	gInlineCodeTemplate, _ = template.New("InlineCode").Parse(`<code>{{.}}</code>`)
 	gCommentTemplate, _ = template.New("Comment").Parse(`<!--{{.}}-->` + "\n")
-	gBlockTexTemplate, _ = template.New("BlockTex").Parse(`<p><a id="{{.Id}}" class="caption">{{.Numbering}} {{.Caption}}</a></p><div class="math">\[{{.Value}}\]</div>` + "\n")
+	gBlockTexTemplate, _ = template.New("BlockTex").Parse(`<p><a id="{{.Id}}" class="caption">{{.Numbering}} {{.Caption}}</a></p><div class="math">{{if .MathML}}{{.MathML}}{{else}}\[{{.Value}}\]{{end}}</div>` + "\n")
 	gBlockCodeTemplate, _ = template.New("BlockCode").Parse(`<p><a id="{{.Id}}" class="caption">{{.Numbering}} {{.Caption}}</a></p><pre>{{.Value}}</pre>` + "\n")
 	gListTemplate, _ = template.New("List").Parse(`<p><a id="{{.Id}}" class="caption">{{.Numbering}} {{.Caption}}</a></p><{{.ListType}}>{{.Value}}</{{.ListType}}>` + "\n")
 	gListItemTemplate, _ = template.New("ListItem").Parse(`<li>{{.}}</li>` + "\n")
 	gAnchorTemplate, _ = template.New("Anchor").Parse(`<a id="{{.Id}}" class="anchor">{{.Value}}</a>`)
-	gReferToTemplate, _ = template.New("ReferTo").Parse(`<a class="referto" href="#{{.Id}}">{{.Id}}</a>`)
+	gReferToTemplate, _ = template.New("ReferTo").Parse(`<a class="referto" href="{{.Href}}">{{.Value}}</a>`)
 	gTableTemplate, _ = template.New("Table").Parse(`<p><a id="{{.Id}}" class="caption">{{.Numbering}} {{.Caption}}</a></p><table>{{.Content}}</table>` + "\n")
 	gTableRowTemplate, _ = template.New("TableRow").Parse(`<tr>{{.}}</tr>` + "\n")
-	gTableCellTemplate, _ = template.New("TableCell").Parse(`<td>{{.}}</td>`)
+	gTableCellTemplate, _ = template.New("TableCell").Parse(`<{{.Tag}}{{if gt .ColSpan 1}} colspan="{{.ColSpan}}"{{end}}{{if gt .RowSpan 1}} rowspan="{{.RowSpan}}"{{end}}` +
+		`{{with .Align}} style="text-align:{{.}}"{{end}}>{{.Content}}</{{.Tag}}>`)
+	gTableGroupTemplate, _ = template.New("TableGroup").Parse(`<{{.Tag}}>` + "\n" + `{{.Content}}</{{.Tag}}>` + "\n")
 	gImageTemplate, _ = template.New("Image").Parse(`<p><a id="{{.Id}}" class="caption">{{.Numbering}} {{.Caption}}</a></p><img src="{{.Src}}" alt="{{.Caption}}">`)
+	gChartTemplate, _ = template.New("Chart").Parse(`<p><a id="{{.Id}}" class="caption">{{.Numbering}} {{.Caption}}</a></p><div class="chart">{{.SVG}}</div>` + "\n")
+	gDiagramTemplate, _ = template.New("Diagram").Parse(`<p><a id="{{.Id}}" class="caption">{{.Numbering}} {{.Caption}}</a></p><div class="diagram">{{.SVG}}</div>` + "\n")
 	gGlobalIndexTemplate, _ = template.New("GlobalIndex").Parse(`<p><a href="#{{.Id}}">{{.Numbering}} {{.Caption}}</a></p>` + "\n")
+	gFootnoteTemplate, _ = template.New("Footnote").Parse(`<sup class="footnote-ref"><a id="{{.Id}}-ref" href="#{{.Id}}">{{.Number}}</a></sup>`)
+	gFootnoteListTemplate, _ = template.New("FootnoteList").Parse(`<div class="footnotes">` + "\n" +
+		`{{range .}}<p class="footnote" id="{{.Id}}"><a href="#{{.Id}}-ref">{{.Number}}</a> {{.Content}}</p>` + "\n" + `{{end}}</div>` + "\n")
+	gCiteTemplate, _ = template.New("Cite").Parse(`[{{range $i, $e := .}}{{if $i}}, {{end}}{{if $e}}<a class="cite" href="#{{$e.Id}}">{{$e.Number}}</a>{{else}}?{{end}}{{end}}]`)
+	gBibliographyTemplate, _ = template.New("Bibliography").Parse(`<div class="bibliography">` + "\n" +
+		`{{range .}}<p class="reference" id="{{.Id}}">[{{.Number}}] {{.Reference}}</p>` + "\n" + `{{end}}</div>` + "\n")
+	gIndexTermTemplate, _ = template.New("IndexTerm").Parse(`<a id="{{.Id}}" class="index-term"></a>`)
+	gTermIndexTemplate, _ = template.New("TermIndex").Parse(`<div class="term-index">` + "\n" + `{{range .}}<p class="term-index-group"><strong>{{.Initial}}</strong></p>` + "\n" +
+		`{{range .Entries}}<p class="term-index-{{if .Sub}}subentry{{else}}entry{{end}}">{{.Term}}{{range .Refs}} <a href="#{{.Id}}">{{.Text}}</a>{{end}}</p>` + "\n" + `{{end}}{{end}}</div>` + "\n")
 	gSectionIndexTemplate, _ = template.New("SectionIndex").Parse(`<p><a href="#{{.Id}}">{{.Numbering}} {{.Caption}}</a></p>` + "\n")
 	gTitleTemplate, _ = template.New("Title").Parse(`<h{{.Level}} class="title{{.Level}}">{{.Title}}</h{{.Level}}>` + "\n")
 	gMetaDataTemplate, _ = template.New("MetaData").Parse(`<span class="meta-data-name"><strong>{{.Name}}:</strong></span> <span class="meta-data-value">{{.Value}}</span>` + "\n")
 }
 
-func InlineChunkListRender(chunkList []Chunk) ([]Chunk, error) {
+func (doc *Doc) InlineChunkListRender(chunkList []Chunk) ([]Chunk, error) {
 	var (
 		curr         Chunk
 		outputChunks []Chunk
@@ -91,11 +112,10 @@ func InlineChunkListRender(chunkList []Chunk) ([]Chunk, error) {
 		curr = chunkList[i]
 
 		if keyword, isKeyword := curr.(*KeywordChunk); isKeyword {
-			if gInlineFormatMap[keyword.Keyword] {
-				str, err := KeywordChunkRender(curr)
+			if handler := lookupKeyword(keyword.Keyword); handler != nil && handler.Inline {
+				str, err := doc.KeywordChunkRender(curr)
 				if err != nil {
-					log.Fatalln(err)
-					return outputChunks, err
+					return outputChunks, newDiagnostic(curr, err)
 				}
 				pushToOutputChunks(&PlainTextChunk{Position: curr.GetPosition(), Value: str})
 				continue
@@ -108,24 +128,33 @@ func InlineChunkListRender(chunkList []Chunk) ([]Chunk, error) {
 	return outputChunks, nil
 }
 
-func ChunkRender(chunk Chunk) (string, error) {
+//inlineChunkListRender renders chunkList as inline content whenever it is called, i.e. without <p> around plain text
+func (doc *Doc) inlineChunkListRender(chunkList []Chunk) (string, error) {
+	inlineRenderMode := doc.inlineRenderMode
+	doc.inlineRenderMode = true
+	defer func() {
+		doc.inlineRenderMode = inlineRenderMode
+	}()
+	return doc.ChunkListRender(chunkList)
+}
+
+func (doc *Doc) ChunkRender(chunk Chunk) (string, error) {
 	switch chunk.(type) {
 	case *KeywordChunk:
-		return KeywordChunkRender(chunk)
+		return doc.KeywordChunkRender(chunk)
 	case *PlainTextChunk:
-		return PlainTextChunkRender(chunk)
+		return doc.PlainTextChunkRender(chunk)
 	case *RawTextChunk:
 		return RawTextChunkRender(chunk)
 	default:
-		log.Fatalln("not implemented")
-		panic("not implemented")
+		return "", newDiagnostic(chunk, errUnexpectedChunk)
 	}
 }
 
-func ChunkListRender(chunkList []Chunk) (string, error) {
+func (doc *Doc) ChunkListRender(chunkList []Chunk) (string, error) {
 	var buf bytes.Buffer
 	for _, chunk := range chunkList {
-		text, err := ChunkRender(chunk)
+		text, err := doc.ChunkRender(chunk)
 		if err != nil {
 			return buf.String(), err
 		}
@@ -134,132 +163,140 @@ func ChunkListRender(chunkList []Chunk) (string, error) {
 	return buf.String(), nil
 }
 
-func KeywordChunkRender(chunk Chunk) (string, error) {
-	keywordChunk := chunk.(*KeywordChunk)
-	var err error
+func (doc *Doc) KeywordChunkRender(chunk Chunk) (string, error) {
+	keywordChunk, ok := chunk.(*KeywordChunk)
+	if !ok {
+		return "", newDiagnostic(chunk, errUnexpectedChunk)
+	}
+	handler := lookupKeyword(keywordChunk.Keyword)
+	if handler == nil {
+		return "", newDiagnostic(keywordChunk, errNotImplemented)
+	}
+	text, err := handler.Render(doc, keywordChunk)
+	if err != nil {
+		return text, newDiagnostic(keywordChunk, err)
+	}
+	return text, nil
+}
+
+//builtinKeywordRender is the Render of built-in keywords
+func (doc *Doc) builtinKeywordRender(keywordChunk *KeywordChunk) (string, error) {
+	//the node checks the children of keywordChunk, so that ill-formed chunks are reported rather than panic
+	node, err := newKeywordNode(keywordChunk)
+	if err != nil {
+		return "", err
+	}
 	var text string
 	var buf bytes.Buffer
-	switch keywordChunk.Keyword {
-	case EmphasisFormat:
-		text, err = ChunkRender(keywordChunk.Children[0]) //only care one child
+	switch n := node.(type) {
+	case *FormatNode:
+		return doc.formatRender(keywordChunk)
+	case *ImageNode:
+		err = gImageTemplate.Execute(&buf, n.Image)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-		err = gEmphasisTemplate.Execute(&buf, text)
+	case *ChartNode:
+		err = gChartTemplate.Execute(&buf, n.Chart)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-	case StrongFormat:
-		text, err = ChunkRender(keywordChunk.Children[0]) //only care one child
+	case *DiagramNode:
+		err = gDiagramTemplate.Execute(&buf, n.Diagram)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-		err = gStrongTemplate.Execute(&buf, text)
+	case *BlockTexNode:
+		err = gBlockTexTemplate.Execute(&buf, n.Tex)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-	case HyperLink:
-		url, err := ChunkRender(keywordChunk.Children[0])
+	case *BlockCodeNode:
+		err = gBlockCodeTemplate.Execute(&buf, n.Code)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-		content, err := ChunkRender(keywordChunk.Children[1])
+	case *AnchorNode:
+		err = gAnchorTemplate.Execute(&buf, n.Anchor)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-		err = gHyperLinkTemplate.Execute(&buf, struct{ Url, Text string }{url, content})
+	case *ReferToNode:
+		err = gReferToTemplate.Execute(&buf, n.ReferTo)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-	case ImageKeyword:
-		imageChunk := keywordChunk.Children[0].(*ImageChunk)
-		err = gImageTemplate.Execute(&buf, imageChunk)
+	case *FootnoteNode:
+		err = gFootnoteTemplate.Execute(&buf, n.Footnote)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-	case InlineTex:
-		text, err = ChunkRender(keywordChunk.Children[0])
+	case *InlineTexNode:
+		err = gInlineTexTemplate.Execute(&buf, n.Tex)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-		err = gInlineTexTemplate.Execute(&buf, text)
+	case *CiteNode:
+		err = gCiteTemplate.Execute(&buf, n.Cite.Entries)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-	case InlineCode:
-		text, err = ChunkRender(keywordChunk.Children[0])
-		if err != nil {
-			log.Println(err)
-			return text, err
-		}
-		err = gInlineCodeTemplate.Execute(&buf, text)
-		if err != nil {
-			log.Println(err)
-			return text, err
-		}
-	case CommentKeyword:
-		err = gCommentTemplate.Execute(&buf, keywordChunk.Children[0].GetValue())
-		if err != nil {
-			log.Println(err)
-			return text, err
-		}
-	case BlockTex:
-		blockTexChunk := keywordChunk.Children[0].(*BlockTexChunk)
-		err = gBlockTexTemplate.Execute(&buf, blockTexChunk)
-		if err != nil {
-			log.Println(err)
-			return text, err
+	case *BibliographyNode:
+		//the cited entries of the file, in the order of first citation
+		var entries []*BibEntry
+		for _, entry := range n.Bibliography.Entries {
+			if entry.Number > 0 && doc.bibEntries[entry.Key] == entry {
+				entries = append(entries, entry)
+			}
 		}
-	case BlockCode:
-		blockCodeChunk := keywordChunk.Children[0].(*BlockCodeChunk)
-		err = gBlockCodeTemplate.Execute(&buf, blockCodeChunk)
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Number < entries[j].Number
+		})
+		err = gBibliographyTemplate.Execute(&buf, entries)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-	case AnchorBlock:
-		anchorChunk := keywordChunk.Children[0].(*AnchorChunk)
-		err = gAnchorTemplate.Execute(&buf, anchorChunk)
+	case *IndexTermNode:
+		err = gIndexTermTemplate.Execute(&buf, n.Term)
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-	case ReferToBlock:
-		referToChunk := keywordChunk.Children[0].(*ReferToChunk)
-		err = gReferToTemplate.Execute(&buf, referToChunk)
+	case *SectionNode:
+		sectionChunk := n.Section
+		content, err := doc.ChunkListRender(sectionChunk.Children)
 		if err != nil {
-			log.Println(err)
 			return text, err
 		}
-	case SectionHeader, SectionHeader1, SectionHeader2, SectionHeader3,
-		SectionHeader4, SectionHeader5, SectionHeader6:
-		sectionChunk := keywordChunk.Children[0].(*SectionChunk)
-		err = gSectionTemplate.Execute(&buf, sectionChunk)
+		err = gSectionTemplate.Execute(&buf, struct {
+			*SectionChunk
+			Content string
+		}{sectionChunk, content})
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
-	case OrderList, BulletList:
-		listChunk := keywordChunk.Children[0].(*ListChunk)
+	case *ListNode:
+		listChunk := n.List
 		var tmpBuf bytes.Buffer
 		for _, item := range listChunk.Items {
-			itemText, err := ChunkListRender(item.Value)
+			itemText, err := doc.ChunkListRender(item.Value)
 			if err != nil {
 				return text, err
 			}
 			err = gListItemTemplate.Execute(&tmpBuf, itemText)
 			if err != nil {
-				log.Fatalln(err)
 				return text, err
 			}
 		}
@@ -268,104 +305,204 @@ func KeywordChunkRender(chunk Chunk) (string, error) {
 			log.Println(err)
 			return text, err
 		}
-	case TableKeyword:
-		tableChunk := keywordChunk.Children[0].(*TableChunk)
-		var rowBuf bytes.Buffer
+	case *TableNode:
+		tableChunk := n.Table
+		var headBuf, rowBuf bytes.Buffer
 
 		for row := 0; row < len(tableChunk.Cells); row++ {
-			rowChunks := tableChunk.Cells[row]
+			rowCells := tableChunk.Cells[row]
+			tag := "td"
+			if tableChunk.IsHeaderRow(row) {
+				tag = "th"
+			}
 			var cellBuf bytes.Buffer
-			for col := 0; col < len(rowChunks); col++ {
-				cellChunk := rowChunks[col]
-
-				err := gTableCellTemplate.Execute(&cellBuf, cellChunk.GetValue())
+			for _, cell := range rowCells {
+				cellText, err := doc.inlineChunkListRender(cell.Value)
+				if err != nil {
+					return text, err
+				}
+				err = gTableCellTemplate.Execute(&cellBuf, struct {
+					*TableCell
+					Tag     string
+					Align   ColumnAlign
+					Content string
+				}{cell, tag, tableChunk.Align(cell.Column), cellText})
 				if err != nil {
 					return text, err
 				}
 			}
 
-			err := gTableRowTemplate.Execute(&rowBuf, cellBuf.String())
+			rowOut := &rowBuf
+			if tableChunk.IsHeaderRow(row) {
+				rowOut = &headBuf
+			}
+			err := gTableRowTemplate.Execute(rowOut, cellBuf.String())
 			if err != nil {
 				return text, err
 			}
 
 		}
-		err := gTableTemplate.Execute(&buf, struct{ Id, Caption, Numbering, Content string }{tableChunk.Id, tableChunk.Caption, tableChunk.Numbering, rowBuf.String()})
+		content := rowBuf.String()
+		if tableChunk.HeaderRows > 0 {
+			//the header rows and the body rows are grouped only if there are headers, the plain tables are kept as they are
+			var groupBuf bytes.Buffer
+			for _, group := range []struct{ Tag, Content string }{{"thead", headBuf.String()}, {"tbody", rowBuf.String()}} {
+				if group.Content == "" {
+					continue
+				}
+				err := gTableGroupTemplate.Execute(&groupBuf, group)
+				if err != nil {
+					return text, err
+				}
+			}
+			content = groupBuf.String()
+		}
+		err := gTableTemplate.Execute(&buf, struct{ Id, Caption, Numbering, Content string }{tableChunk.Id, tableChunk.Caption, tableChunk.Numbering, content})
 		if err != nil {
 			log.Println(err)
 			return text, err
 		}
+	case *IndexNode:
+		return doc.indexRender(keywordChunk)
+	case *MetaNode:
+		return doc.metaRender(keywordChunk)
+	default:
+		return text, newDiagnostic(keywordChunk, errNotImplemented)
+	}
+	return buf.String(), nil
+}
 
-	//output different kind of index
+//formatRender renders inline format, newKeywordNode makes sure the children are there
+func (doc *Doc) formatRender(keywordChunk *KeywordChunk) (string, error) {
+	var err error
+	var text string
+	var buf bytes.Buffer
+	switch keywordChunk.Keyword {
+	case EmphasisFormat:
+		text, err = doc.ChunkRender(keywordChunk.Children[0]) //only care one child
+		if err != nil {
+			log.Println(err)
+			return text, err
+		}
+		err = gEmphasisTemplate.Execute(&buf, text)
+		if err != nil {
+			log.Println(err)
+			return text, err
+		}
+	case StrongFormat:
+		text, err = doc.ChunkRender(keywordChunk.Children[0]) //only care one child
+		if err != nil {
+			log.Println(err)
+			return text, err
+		}
+		err = gStrongTemplate.Execute(&buf, text)
+		if err != nil {
+			log.Println(err)
+			return text, err
+		}
+	case HyperLink:
+		url, err := doc.ChunkRender(keywordChunk.Children[0])
+		if err != nil {
+			log.Println(err)
+			return text, err
+		}
+		content, err := doc.ChunkRender(keywordChunk.Children[1])
+		if err != nil {
+			log.Println(err)
+			return text, err
+		}
+		err = gHyperLinkTemplate.Execute(&buf, struct{ Url, Text string }{url, content})
+		if err != nil {
+			log.Println(err)
+			return text, err
+		}
+	case InlineCode:
+		text, err = doc.ChunkRender(keywordChunk.Children[0])
+		if err != nil {
+			log.Println(err)
+			return text, err
+		}
+		err = gInlineCodeTemplate.Execute(&buf, text)
+		if err != nil {
+			log.Println(err)
+			return text, err
+		}
+	case CommentKeyword:
+		err = gCommentTemplate.Execute(&buf, keywordChunk.Children[0].GetValue())
+		if err != nil {
+			log.Println(err)
+			return text, err
+		}
+	}
+	return buf.String(), nil
+}
+
+//indexRender outputs different kind of index
+func (doc *Doc) indexRender(keywordChunk *KeywordChunk) (string, error) {
+	switch keywordChunk.Keyword {
 	case SectionIndexKeyword:
-		return gDoc.SectionIndex, nil
+		return doc.SectionIndex, nil
 	case ImageIndexKeyword:
-		return gDoc.ImageIndex, nil
+		return doc.ImageIndex, nil
 	case TableIndexKeyword:
-		return gDoc.TableIndex, nil
+		return doc.TableIndex, nil
+	case ChartIndexKeyword:
+		return doc.ChartIndex, nil
+	case DiagramIndexKeyword:
+		return doc.DiagramIndex, nil
 	case OrderListIndexKeyword:
-		return gDoc.OrderListIndex, nil
+		return doc.OrderListIndex, nil
 	case BulletListIndexKeyword:
-		return gDoc.BulletListIndex, nil
+		return doc.BulletListIndex, nil
 	case CodeIndexKeyword:
-		return gDoc.CodeIndex, nil
+		return doc.CodeIndex, nil
 	case MathIndexKeyword:
-		return gDoc.MathIndex, nil
+		return doc.MathIndex, nil
+	case TermIndexKeyword:
+		return doc.TermIndex, nil
+	}
+	return "", newDiagnostic(keywordChunk, errNotImplemented)
+}
 
-	//different kind of meta data handling
+//metaRender handles different kind of meta data
+func (doc *Doc) metaRender(keywordChunk *KeywordChunk) (string, error) {
+	var err error
+	var buf bytes.Buffer
+	switch keywordChunk.Keyword {
 	case TitleKeyword:
 		err = gTitleTemplate.Execute(&buf, struct {
 			Level int
 			Title string
-		}{1, gDoc.Title})
-		if err != nil {
-			return text, err
-		}
+		}{1, doc.Title})
 
 	case SubTitleKeyword:
 		err = gTitleTemplate.Execute(&buf, struct {
 			Level int
 			Title string
-		}{2, gDoc.SubTitle})
-		if err != nil {
-			return text, err
-		}
+		}{2, doc.SubTitle})
 
 	case AuthorKeyword:
-		err = gMetaDataTemplate.Execute(&buf, struct{ Name, Value string }{getKeywordName(AuthorKeyword), gDoc.Author})
-		if err != nil {
-			return text, err
-		}
+		err = gMetaDataTemplate.Execute(&buf, struct{ Name, Value string }{doc.getKeywordName(AuthorKeyword), doc.Author})
 
 	case CreateDateKeyword:
-		err = gMetaDataTemplate.Execute(&buf, struct{ Name, Value string }{getKeywordName(CreateDateKeyword), gDoc.CreateDate})
-		if err != nil {
-			return text, err
-		}
+		err = gMetaDataTemplate.Execute(&buf, struct{ Name, Value string }{doc.getKeywordName(CreateDateKeyword), doc.CreateDate})
 	case ModifyDateKeyword:
-		err = gMetaDataTemplate.Execute(&buf, struct{ Name, Value string }{getKeywordName(ModifyDateKeyword), gDoc.ModifyDate})
-		if err != nil {
-			return text, err
-		}
+		err = gMetaDataTemplate.Execute(&buf, struct{ Name, Value string }{doc.getKeywordName(ModifyDateKeyword), doc.ModifyDate})
 	case KeywordsKeyword:
-		err = gMetaDataTemplate.Execute(&buf, struct{ Name, Value string }{getKeywordName(KeywordsKeyword), gDoc.Keywords})
-		if err != nil {
-			return text, err
-		}
+		err = gMetaDataTemplate.Execute(&buf, struct{ Name, Value string }{doc.getKeywordName(KeywordsKeyword), doc.Keywords})
 
 	default:
-		log.Fatal(errNotImplemented)
-		panic(errNotImplemented)
+		err = newDiagnostic(keywordChunk, errNotImplemented)
 	}
-	return buf.String(), nil
+	return buf.String(), err
 }
 
 func RawTextChunkRender(chunk Chunk) (string, error) {
 	return chunk.GetValue(), nil
 }
 
-func PlainTextChunkRender(chunk Chunk) (string, error) {
-	if gInlineRenderMode {
+func (doc *Doc) PlainTextChunkRender(chunk Chunk) (string, error) {
+	if doc.inlineRenderMode {
 		return chunk.GetValue(), nil
 	}
 
@@ -1,4 +1,4 @@
-package main
+package hairtail
 
 import (
 	"bytes"
@@ -133,14 +133,14 @@ func RawTextChunkHandle(input string) ([]Chunk, error) {
 		}
 		newHandler, err := handler(i, arune)
 		if err != nil {
-			return chunks, err
+			return chunks, &Diagnostic{Position: i, Err: err}
 		}
 		handler = newHandler
 	}
 
 	//check if the current state is legal
 	if state != waitEscapeChar {
-		return nil, fmt.Errorf("illegal state after handling the whole input text state=%d", state)
+		return nil, &Diagnostic{Position: startPos, Err: fmt.Errorf("illegal state after handling the whole input text state=%d", state)}
 	}
 
 	//check if there are remaining content in the buf at last
@@ -1,4 +1,4 @@
-package main
+package hairtail
 
 import (
 	"fmt"
@@ -7,14 +7,16 @@ import (
 // ReferToChunk denotes anchors(inner article link) in article.
 type ReferToChunk struct {
 	Position int
+	File     string //the file of \k{file#id}, empty if the id is in the same document or unique in the build
 	Id       string
-	Value    string //if required, the value is get from the referred to chunk
+	Href     string //where the link goes, "#id" in the same document, or "file.html#id" in a build
+	Value    string //the text of the link, either given by \k{id}{text} or get from the referred to chunk
 }
 
 // String implements the Stringer interface
 func (p ReferToChunk) String() string {
-	return fmt.Sprintf("ReferToChunk{Position: %d, Id: %v, Value: %v }",
-		p.GetPosition(), p.Id, p.GetValue())
+	return fmt.Sprintf("ReferToChunk{Position: %d, File: %v, Id: %v, Href: %v, Value: %v }",
+		p.GetPosition(), p.File, p.Id, p.Href, p.GetValue())
 }
 
 // GetPosition implements the Chunk interface
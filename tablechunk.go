@@ -1,22 +1,116 @@
-package main
+package hairtail
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
+var (
+	errUnknownTableOption = errors.New("unknown table option")
+	errInvalidTableOption = errors.New("invalid table option")
+	errInvalidTableSpan   = errors.New("invalid span, expect a positive number")
+	errRaggedTable        = errors.New("ragged table")
+)
+
+// ColumnAlign is the horizontal alignment of the cells of a table column
+type ColumnAlign string
+
+const (
+	AlignDefault ColumnAlign = "" //left to the renderer
+	AlignLeft    ColumnAlign = "left"
+	AlignCenter  ColumnAlign = "center"
+	AlignRight   ColumnAlign = "right"
+)
+
+// gColumnAlignLetters maps the letters of align=lcr to alignments, "-" keeps the default
+var gColumnAlignLetters = map[rune]ColumnAlign{
+	'l': AlignLeft,
+	'c': AlignCenter,
+	'r': AlignRight,
+	'-': AlignDefault,
+}
+
+// gTableDelimiters maps the names of delimiter=name to chars, the chars not easy to write in options
+var gTableDelimiters = map[string]rune{
+	"tab":       '\t',
+	"comma":     ',',
+	"semicolon": ';',
+	"space":     ' ',
+}
+
+// TableCell is a cell of table
+type TableCell struct {
+	Position int
+	Value    []Chunk //may contain inline chunks, or blocks if the table has option rows=explicit
+	ColSpan  int     //the number of columns the cell spans, at least 1
+	RowSpan  int     //the number of rows the cell spans, at least 1
+	Column   int     //0 based, the column the cell starts at, counting the columns spanned by the cells before and above it
+}
+
+// newTableCell returns an empty cell spanning one column and one row
+func newTableCell(pos int) *TableCell {
+	return &TableCell{Position: pos, ColSpan: 1, RowSpan: 1}
+}
+
+// String implements the Stringer interface
+func (p TableCell) String() string {
+	return fmt.Sprintf("TableCell{Position: %d, ColSpan: %d, RowSpan: %d, Column: %d, Value: %v}", p.Position, p.ColSpan, p.RowSpan, p.Column, p.Value)
+}
+
+// TableSpanChunk denotes \span{cols}{rows} in a cell
+type TableSpanChunk struct {
+	Position int
+	ColSpan  int
+	RowSpan  int
+}
+
+// String implements the Stringer interface
+func (p TableSpanChunk) String() string {
+	return fmt.Sprintf("TableSpanChunk{Position: %d, ColSpan: %d, RowSpan: %d}", p.Position, p.ColSpan, p.RowSpan)
+}
+
+// GetPosition implements the Chunk interface
+func (p *TableSpanChunk) GetPosition() int {
+	return p.Position
+}
+
+// SetPosition implements the Chunk interface
+func (p *TableSpanChunk) SetPosition(pos int) {
+	p.Position = pos
+}
+
+// GetValue implements the Chunk interface
+func (p *TableSpanChunk) GetValue() string {
+	return fmt.Sprintf("%d %d", p.ColSpan, p.RowSpan)
+}
+
 // TableChunk denotes table
 type TableChunk struct {
 	Position  int
 	Id        string
-	Caption   string //optional
-	Numbering string //optional Numbering before Caption
-	Cells     [][]Chunk
+	Caption   string         //optional
+	Numbering string         //optional Numbering before Caption
+	Cells     [][]*TableCell //by row, the columns spanned by a cell have no cells of their own
+	Columns   int            //the number of columns of every row, counting the spanned columns
+	//HeaderRows is the number of rows at the top being headers, set by header=n
+	HeaderRows int
+	//Aligns is the alignment of the columns in order, set by align=lcr, the columns beyond it are AlignDefault
+	Aligns []ColumnAlign
+	//File is the CSV or TSV file the rows are imported from, set by file=path
+	File string
+	//ExplicitRows is set by rows=explicit, the rows are ended by \tr only, so that a cell may hold several lines or blocks
+	ExplicitRows bool
+
+	delimiter rune  //the delimiter of the fields of File, set by delimiter=c
+	columns   []int //0 based, the columns of File imported in order, set by columns=1,3-4, all of them if nil
 }
 
 // String implements the Stringer interface
 func (p TableChunk) String() string {
-	return fmt.Sprintf("TableChunk{Position: %d, Id: %v, Caption: %v, Cells: %v}",
-		p.GetPosition(), p.Id, p.Caption, p.Cells)
+	return fmt.Sprintf("TableChunk{Position: %d, Id: %v, Caption: %v, HeaderRows: %d, Aligns: %v, Cells: %v}",
+		p.GetPosition(), p.Id, p.Caption, p.HeaderRows, p.Aligns, p.Cells)
 }
 
 // GetPosition implements the Chunk interface
@@ -51,3 +145,138 @@ func (p *TableChunk) SetNumbering(c string) {
 func (p TableChunk) GetNumbering() string {
 	return p.Numbering
 }
+
+// Align returns the alignment of column col, 0 based
+func (p *TableChunk) Align(col int) ColumnAlign {
+	if col < len(p.Aligns) {
+		return p.Aligns[col]
+	}
+	return AlignDefault
+}
+
+// IsHeaderRow reports whether row, 0 based, is one of the header rows
+func (p *TableChunk) IsHeaderRow(row int) bool {
+	return row < p.HeaderRows
+}
+
+// setOptions parses the options of \table{id}{options}{...}, which are separated by blanks, e.g. "header=1 align=lrr".
+// otherOption handles the options not of table, it may be nil.
+func (p *TableChunk) setOptions(options string, otherOption func(key, value string) error) error {
+	for _, option := range strings.Fields(options) {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%w %q, expect key=value", errInvalidTableOption, option)
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "header":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%w %q, expect the number of header rows", errInvalidTableOption, option)
+			}
+			p.HeaderRows = n
+		case "rows":
+			switch value {
+			case "lines":
+				p.ExplicitRows = false
+			case "explicit":
+				p.ExplicitRows = true
+			default:
+				return fmt.Errorf("%w %q, expect lines or explicit", errInvalidTableOption, option)
+			}
+		case "file":
+			p.File = value
+		case "delimiter":
+			delimiter, ok := gTableDelimiters[value]
+			if !ok {
+				runes := []rune(value)
+				if len(runes) != 1 || runes[0] == '"' {
+					return fmt.Errorf("%w %q, expect tab, comma, semicolon or one char", errInvalidTableOption, option)
+				}
+				delimiter = runes[0]
+			}
+			p.delimiter = delimiter
+		case "columns":
+			columns, err := parseColumns(value)
+			if err != nil {
+				return fmt.Errorf("%w %q, %v", errInvalidTableOption, option, err)
+			}
+			p.columns = columns
+		case "align":
+			p.Aligns = nil
+			for _, letter := range value {
+				align, ok := gColumnAlignLetters[letter]
+				if !ok {
+					return fmt.Errorf("%w %q, expect l, c, r or - for every column", errInvalidTableOption, option)
+				}
+				p.Aligns = append(p.Aligns, align)
+			}
+		default:
+			if otherOption == nil {
+				return fmt.Errorf("%w %q", errUnknownTableOption, key)
+			}
+			err := otherOption(key, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if p.File == "" && (p.delimiter != 0 || p.columns != nil) {
+		return fmt.Errorf("%w, delimiter and columns are for file only", errInvalidTableOption)
+	}
+	return nil
+}
+
+// layout places the cells in the grid of the table, i.e. sets Column of every cell and Columns of the table.
+// Every row is expected to cover the same number of columns, counting the cells spanning from the rows above,
+// the rows covering another number of columns are reported.
+func (p *TableChunk) layout() error {
+	var (
+		diagnostics DiagnosticList
+		spanning    []*TableCell //by column, the cell covering the column in the current row
+		rowsLeft    []int        //by column, the number of rows the cell in spanning still covers, including the current row
+	)
+	p.Columns = 0
+	for row, cells := range p.Cells {
+		col := 0
+		for _, cell := range cells {
+			//skip the columns covered from above
+			for col < len(rowsLeft) && rowsLeft[col] > 0 {
+				col++
+			}
+			cell.Column = col
+			for end := col + cell.ColSpan; col < end; col++ {
+				if col >= len(rowsLeft) {
+					spanning = append(spanning, nil)
+					rowsLeft = append(rowsLeft, 0)
+				}
+				spanning[col], rowsLeft[col] = cell, cell.RowSpan
+			}
+		}
+
+		width := 0
+		for col := range rowsLeft {
+			if rowsLeft[col] > 0 {
+				width++
+				rowsLeft[col]--
+			}
+		}
+		if row == 0 {
+			p.Columns = width
+		} else if width != p.Columns {
+			pos := p.Position
+			if len(cells) > 0 {
+				pos = cells[0].Position
+			}
+			diagnostics = append(diagnostics, &Diagnostic{Position: pos, Keyword: TableKeyword,
+				Err: fmt.Errorf("%w, row %d has %d columns, expect %d as row 1", errRaggedTable, row+1, width, p.Columns)})
+		}
+	}
+	for col := range rowsLeft {
+		if rowsLeft[col] > 0 && (col == 0 || spanning[col] != spanning[col-1]) {
+			diagnostics = append(diagnostics, &Diagnostic{Position: spanning[col].Position, Keyword: TableKeyword,
+				Err: fmt.Errorf("%w, the cell spans %d rows below the last row", errRaggedTable, rowsLeft[col])})
+		}
+	}
+	return diagnostics.err()
+}
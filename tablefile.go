@@ -0,0 +1,109 @@
+package hairtail
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errTableColumnNotFound = errors.New("column not found")
+
+// isTableFileOptions reports whether the embraced block chunks are the options of \table{id}{file=path options}
+func isTableFileOptions(chunks []Chunk) bool {
+	options, err := blockText(chunks)
+	if err != nil {
+		return false
+	}
+	for _, option := range strings.Fields(options) {
+		if strings.HasPrefix(option, "file=") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseColumns parses the value of columns=1,3-4, the columns are 1 based in the option and 0 based in the result
+func parseColumns(value string) ([]int, error) {
+	var columns []int
+	for _, part := range strings.Split(value, ",") {
+		first, last := part, part
+		if i := strings.Index(part, "-"); i > 0 {
+			first, last = part[:i], part[i+1:]
+		}
+		from, err := strconv.Atoi(first)
+		if err != nil || from < 1 {
+			return nil, fmt.Errorf("expect column number, got %q", part)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil || to < from {
+			return nil, fmt.Errorf("expect column range, got %q", part)
+		}
+		for col := from; col <= to; col++ {
+			columns = append(columns, col-1)
+		}
+	}
+	return columns, nil
+}
+
+// tableFileRows reads the rows of table from table.File, a CSV file, or a TSV file if its extension is .tsv.
+// The file is found as \include finds it. Every field is a cell of plain text, the keywords in it are not handled.
+func (doc *Doc) tableFileRows(table *TableChunk) ([][]*TableCell, error) {
+	file, err := doc.findIncludedFile("table file", table.File)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimPrefix(content, []byte("\ufeff")) //BOM written by spreadsheets
+
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.Comma = table.delimiter
+	if reader.Comma == 0 {
+		reader.Comma = ','
+		if strings.EqualFold(filepath.Ext(file), ".tsv") {
+			reader.Comma = '\t'
+		}
+	}
+	reader.LazyQuotes = reader.Comma == '\t' //TSV does not quote fields, a quote is taken as it is
+	reader.FieldsPerRecord = -1              //ragged rows are reported by layout as the other tables
+
+	var rows [][]*TableCell
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		columns := table.columns
+		if columns == nil {
+			columns = make([]int, len(record))
+			for col := range columns {
+				columns[col] = col
+			}
+		}
+		var row []*TableCell
+		for _, col := range columns {
+			if col >= len(record) {
+				line, _ := reader.FieldPos(0)
+				return nil, fmt.Errorf("%s:%d: %w, column %d of %d", file, line, errTableColumnNotFound, col+1, len(record))
+			}
+			cell := newTableCell(table.Position)
+			if value := strings.TrimSpace(record[col]); value != "" {
+				cell.Value = []Chunk{&PlainTextChunk{Position: table.Position, Value: value}}
+			}
+			row = append(row, cell)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}